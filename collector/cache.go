@@ -0,0 +1,58 @@
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache holds the values last fetched from each status endpoint, such as
+// their metrics, for a fixed time to live. It is safe for concurrent use.
+type ttlCache[V any] struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedValue[V]
+}
+
+// cachedValue holds a value fetched from a status endpoint.
+type cachedValue[V any] struct {
+	value   V
+	fetched time.Time
+}
+
+// newTTLCache creates a cache holding values for ttl.
+func newTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{
+		ttl:     ttl,
+		entries: make(map[string]cachedValue[V]),
+	}
+}
+
+// get returns the value cached for endpoint and its age, if it is younger
+// than the time to live of the cache.
+func (c *ttlCache[V]) get(endpoint string) (V, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+
+	entry, ok := c.entries[endpoint]
+	if !ok {
+		return zero, 0, false
+	}
+
+	age := time.Since(entry.fetched)
+	if age >= c.ttl {
+		return zero, 0, false
+	}
+
+	return entry.value, age, true
+}
+
+// put caches the value fetched from endpoint.
+func (c *ttlCache[V]) put(endpoint string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[endpoint] = cachedValue[V]{value: value, fetched: time.Now()}
+}
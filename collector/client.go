@@ -0,0 +1,423 @@
+package collector
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// DefaultScrapeTimeout is the timeout of scrapes used by Scraper and by the
+// exporter when NGINX_SCRAPE_TIMEOUT_SECONDS is unset.
+const DefaultScrapeTimeout = 5 * time.Second
+
+// DefaultIdleConnTimeout is the idle connection timeout used by Scraper and
+// by the exporter when NGINX_IDLE_CONN_TIMEOUT_SECONDS is unset. It should
+// exceed the scrape interval for connections to be reused.
+const DefaultIdleConnTimeout = 90 * time.Second
+
+// Limits of idle connections kept alive to the status endpoints.
+const (
+	maxIdleConns        = 100
+	maxIdleConnsPerHost = 4
+)
+
+// DefaultMaxBodyBytes is the body limit used by Scraper and by the exporter
+// when NGINX_STATUS_MAX_BODY_BYTES is unset. It is far more than a
+// stub_status page or an NGINX Plus API response needs.
+const DefaultMaxBodyBytes = 64 << 10
+
+// HTTPClientOpts holds the options of the HTTP client created by
+// NewHTTPClient.
+type HTTPClientOpts struct {
+	// Timeout bounds each request, including reading the response body.
+	Timeout time.Duration
+
+	// IdleConnTimeout is how long connections to the status endpoints are
+	// kept alive for reuse by later scrapes.
+	IdleConnTimeout time.Duration
+
+	// ResponseHeaderTimeout, if not zero, fails requests once it elapses
+	// without response headers, so that endpoints accepting connections but
+	// never responding are detected before the timeout expires.
+	ResponseHeaderTimeout time.Duration
+
+	// MaxBodyBytes, if not zero, caps the size of response bodies, after
+	// decompressing them, so that a broken or hostile endpoint cannot exhaust
+	// the memory of the exporter.
+	MaxBodyBytes int64
+
+	// TLSConfig is used to connect to https endpoints, defaulting to the
+	// default TLS configuration.
+	TLSConfig *tls.Config
+
+	// Proxy, if set, is the forward proxy requests are sent through instead
+	// of the one given by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	Proxy *url.URL
+
+	// H2C sends requests to http endpoints over cleartext HTTP/2 with prior
+	// knowledge. It cannot be combined with Proxy.
+	H2C bool
+
+	// DialControl, if set, is called with the address of every TCP connection
+	// before it is dialed, as net.Dialer.ControlContext, and fails the dial
+	// if it returns an error. The context is the one of the request.
+	DialControl func(ctx context.Context, network, address string, c syscall.RawConn) error
+}
+
+// NewHTTPClient creates an HTTP client for fetching the stub_status metrics
+// with the given options. Redirects are not followed, so that they are
+// reported as a *StatusError.
+func NewHTTPClient(opts HTTPClientOpts) *http.Client {
+	// The dialer has the settings of the dialer of http.DefaultTransport.
+	dialer := &net.Dialer{
+		Timeout:        30 * time.Second,
+		KeepAlive:      30 * time.Second,
+		ControlContext: opts.DialControl,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSClientConfig = opts.TLSConfig
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	transport.RegisterProtocol("unix", &unixTransport{
+		idleConnTimeout:       opts.IdleConnTimeout,
+		responseHeaderTimeout: opts.ResponseHeaderTimeout,
+		transports:            make(map[string]*http.Transport),
+	})
+
+	if opts.Proxy != nil {
+		transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+
+	var rt http.RoundTripper = transport
+	if opts.H2C {
+		rt = newH2CTransport(transport, dialer, opts.IdleConnTimeout, opts.ResponseHeaderTimeout)
+	}
+
+	if opts.MaxBodyBytes > 0 {
+		rt = &limitTransport{maxBytes: opts.MaxBodyBytes, next: rt}
+	}
+
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: rt,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// TLSOpts holds the options of the TLS configuration used to connect to
+// HTTPS status endpoints.
+type TLSOpts struct {
+	// CAFile, if set, contains the CA certificates server certificates are
+	// verified against instead of the system roots.
+	CAFile string
+
+	// CertFile and KeyFile, if set, contain the client certificate and key
+	// presented to the status endpoints. Either both or neither must be set.
+	CertFile string
+	KeyFile  string
+
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig creates the TLS configuration used to connect to HTTPS status
+// endpoints.
+func NewTLSConfig(opts TLSOpts) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("client certificate and key files must be set together")
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %v", opts.CAFile)
+	}
+
+	cfg.RootCAs = pool
+
+	return cfg, nil
+}
+
+// unixTransport is an http.RoundTripper for endpoints in the form
+// unix://<socket path>:<status path>, which issues HTTP requests for the
+// status path over the Unix domain socket at the socket path.
+type unixTransport struct {
+	idleConnTimeout       time.Duration
+	responseHeaderTimeout time.Duration
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *unixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	socketPath, statusPath, _ := strings.Cut(req.URL.Path, ":")
+	if socketPath == "" {
+		return nil, fmt.Errorf("missing socket path in %v", req.URL)
+	}
+
+	if statusPath == "" {
+		statusPath = "/"
+	}
+
+	req = req.Clone(req.Context())
+	req.URL = &url.URL{
+		Scheme:   "http",
+		Host:     "localhost",
+		Path:     statusPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	req.Host = "localhost"
+
+	return t.transport(socketPath).RoundTrip(req)
+}
+
+// transport returns the transport dialing the socket at socketPath, so that
+// connections are only reused for requests to the same socket.
+func (t *unixTransport) transport(socketPath string) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	transport, ok := t.transports[socketPath]
+	if !ok {
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			IdleConnTimeout:       t.idleConnTimeout,
+			ResponseHeaderTimeout: t.responseHeaderTimeout,
+		}
+		t.transports[socketPath] = transport
+	}
+
+	return transport
+}
+
+// h2cTransport is an http.RoundTripper that sends requests to http endpoints
+// over cleartext HTTP/2 with prior knowledge, for endpoints behind proxies
+// that only speak HTTP/2. Other requests are sent by next, which negotiates
+// HTTP/2 with https endpoints.
+type h2cTransport struct {
+	h2c  *http2.Transport
+	next http.RoundTripper
+
+	// headerTimeout, if not zero, bounds the time to receive the response
+	// headers over cleartext HTTP/2, which http2.Transport has no setting for.
+	headerTimeout time.Duration
+}
+
+// errHeaderTimeout is returned by h2cTransport when the response headers are
+// not received in time. Like the error of http.Transport, whose message it
+// uses, it is a net.Error reporting a timeout.
+var errHeaderTimeout error = headerTimeoutError{}
+
+// headerTimeoutError is the type of errHeaderTimeout.
+type headerTimeoutError struct{}
+
+func (headerTimeoutError) Error() string   { return "timeout awaiting response headers" }
+func (headerTimeoutError) Timeout() bool   { return true }
+func (headerTimeoutError) Temporary() bool { return true }
+
+// newH2CTransport creates an h2cTransport connecting with dialer, closing
+// connections idle for idleConnTimeout and giving up on responses whose
+// headers are not received within headerTimeout.
+func newH2CTransport(
+	next http.RoundTripper,
+	dialer *net.Dialer,
+	idleConnTimeout time.Duration,
+	headerTimeout time.Duration,
+) *h2cTransport {
+	return &h2cTransport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: idleConnTimeout,
+		},
+		next:          next,
+		headerTimeout: headerTimeout,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.next.RoundTrip(req)
+	}
+
+	if t.headerTimeout <= 0 {
+		return t.h2c.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.headerTimeout, func() { cancel(errHeaderTimeout) })
+
+	resp, err := t.h2c.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The headers may have been received just as the timer fired, but
+		// the body can no longer be read.
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+
+		return nil, errHeaderTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+
+	// The request is only cancelled once the body is closed, since reading it
+	// depends on the context.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+
+	return resp, nil
+}
+
+// cancelBody is a response body calling cancel once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+// Close closes the body and calls cancel.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// limitTransport is an http.RoundTripper capping the size of response bodies
+// at maxBytes. Gzip-compressed responses are decompressed before the cap is
+// applied, so that a small compressed body cannot expand beyond it.
+type limitTransport struct {
+	maxBytes int64
+	next     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &limitedBody{body: resp.Body, remaining: t.maxBytes, maxBytes: t.maxBytes}
+
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		body.gzip = true
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+
+	resp.Body = body
+
+	return resp, nil
+}
+
+// limitedBody is the body of a response received by limitTransport. Reading
+// past maxBytes fails.
+type limitedBody struct {
+	body      io.ReadCloser
+	gzip      bool
+	r         io.Reader
+	err       error
+	remaining int64
+	maxBytes  int64
+}
+
+// Read implements io.Reader.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if b.r == nil {
+		b.r = b.body
+		if b.gzip {
+			gz, err := gzip.NewReader(b.body)
+			if err != nil {
+				b.err = err
+				return 0, err
+			}
+			b.r = gz
+		}
+	}
+
+	// One byte more than allowed is read to tell a body of exactly maxBytes
+	// from a larger one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.r.Read(p)
+	if int64(n) > b.remaining {
+		b.err = fmt.Errorf("response exceeds %d bytes", b.maxBytes)
+		return int(b.remaining), b.err
+	}
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
+// Close implements io.Closer.
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// RedactURL returns endpoint with any password replaced, so that it can be
+// safely logged. Endpoints that cannot be parsed, and whose password therefore
+// cannot be located, are replaced altogether by "<invalid URL>".
+func RedactURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "<invalid URL>"
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,485 @@
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const validStubStatus = `Active connections: 291
+server accepts handled requests
+ 16630948 16630948 31070465
+Reading: 6 Writing: 179 Waiting: 106
+`
+
+func TestGetStubStatsMaxBodyBytes(t *testing.T) {
+	oversized := validStubStatus + strings.Repeat(" ", 1024)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(oversized))
+	gz.Close()
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		encoding string
+		maxBytes int64
+		wantErr  bool
+	}{
+		{"within limit", []byte(validStubStatus), "", 1024, false},
+		{"exactly at limit", []byte(validStubStatus), "", int64(len(validStubStatus)), false},
+		{"oversized", []byte(oversized), "", 1024, true},
+		{"oversized after decompression", compressed.Bytes(), "gzip", 1024, true},
+		{"no limit", []byte(oversized), "", 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			client := NewHTTPClient(HTTPClientOpts{Timeout: time.Second, MaxBodyBytes: tt.maxBytes})
+
+			_, err := GetStubStats(context.Background(), client, srv.URL)
+			if tt.wantErr {
+				if !errors.Is(err, ErrRead) || !strings.Contains(err.Error(), "response exceeds") {
+					t.Fatalf("GetStubStats() error = %v, want a read error for the oversized body", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetStubStats() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestGetStubStatsResponseHeaderTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h2c  bool
+	}{
+		{"http/1.1", false},
+		{"h2c", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			})
+			if tt.h2c {
+				handler = h2c.NewHandler(handler, &http2.Server{})
+			}
+
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+			defer close(release)
+
+			client := NewHTTPClient(HTTPClientOpts{
+				Timeout:               time.Minute,
+				ResponseHeaderTimeout: 50 * time.Millisecond,
+				H2C:                   tt.h2c,
+			})
+
+			start := time.Now()
+			_, err := GetStubStats(context.Background(), client, srv.URL)
+			if err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+				t.Fatalf("GetStubStats() error = %v, want a response header timeout", err)
+			}
+			if reason := scrapeErrorReason(err); reason != "timeout" {
+				t.Errorf("scrapeErrorReason(%v) = %q, want %q", err, reason, "timeout")
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("GetStubStats() took %v, want it to give up after the response header timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestGetStubStatsH2C(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		io.WriteString(w, validStubStatus)
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	client := NewHTTPClient(HTTPClientOpts{
+		Timeout:               time.Second,
+		ResponseHeaderTimeout: time.Second,
+		H2C:                   true,
+	})
+
+	stats, err := GetStubStats(context.Background(), client, srv.URL)
+	if err != nil {
+		t.Fatalf("GetStubStats() error = %v", err)
+	}
+	if stats.Connections.Active != 291 {
+		t.Errorf("active connections = %v, want 291", stats.Connections.Active)
+	}
+}
+
+func TestGetStubStatsHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		io.WriteString(w, validStubStatus)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := NewHTTPClient(HTTPClientOpts{
+		Timeout:   time.Second,
+		TLSConfig: &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+	})
+
+	stats, err := GetStubStats(context.Background(), client, srv.URL)
+	if err != nil {
+		t.Fatalf("GetStubStats() error = %v", err)
+	}
+	if stats.Connections.Active != 291 {
+		t.Errorf("active connections = %v, want 291", stats.Connections.Active)
+	}
+}
+
+func TestGetStubStatsUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "nginx.sock")
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stub_status" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, validStubStatus)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := NewHTTPClient(HTTPClientOpts{Timeout: time.Second})
+
+	stats, err := GetStubStats(context.Background(), client, "unix://"+socketPath+":/stub_status")
+	if err != nil {
+		t.Fatalf("GetStubStats() error = %v", err)
+	}
+	if stats.Connections.Active != 291 || stats.Requests != 31070465 {
+		t.Errorf("GetStubStats() = %+v, want the stats served over the socket", stats)
+	}
+
+	if _, err := GetStubStats(context.Background(), client, "unix://"+socketPath+":/other"); !errors.Is(err, ErrHTTPStatus) {
+		t.Errorf("GetStubStats() error = %v, want ErrHTTPStatus for another status path", err)
+	}
+}
+
+func BenchmarkGetStubStats(b *testing.B) {
+	for _, bb := range []struct {
+		name      string
+		keepAlive bool
+	}{
+		{"keep-alive", true},
+		{"new connection per scrape", false},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var conns atomic.Int64
+
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, validStubStatus)
+			}))
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+
+			client := NewHTTPClient(HTTPClientOpts{Timeout: time.Second, IdleConnTimeout: DefaultIdleConnTimeout})
+			if !bb.keepAlive {
+				client.Transport.(*http.Transport).DisableKeepAlives = true
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				if _, err := GetStubStats(context.Background(), client, srv.URL); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestGetStubStatsGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(validStubStatus))
+	gz.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, validStubStatus)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	for name, client := range map[string]*http.Client{
+		"default client":              {},
+		"client limiting body size":   NewHTTPClient(HTTPClientOpts{Timeout: time.Second, MaxBodyBytes: DefaultMaxBodyBytes}),
+		"client without a body limit": NewHTTPClient(HTTPClientOpts{Timeout: time.Second}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			stats, err := GetStubStats(context.Background(), client, srv.URL)
+			if err != nil {
+				t.Fatalf("GetStubStats() error = %v", err)
+			}
+			if stats.Connections.Active != 291 || stats.Requests != 31070465 {
+				t.Errorf("GetStubStats() = %+v, want the decompressed stats", stats)
+			}
+
+			body, _, err := GetStatusBody(context.Background(), client, srv.URL)
+			if err != nil {
+				t.Fatalf("GetStatusBody() error = %v", err)
+			}
+			if string(body) != validStubStatus {
+				t.Errorf("GetStatusBody() = %q, want the decompressed body", body)
+			}
+		})
+	}
+}
+
+func TestGetStubStatsIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, validStubStatus)
+	})
+
+	srv := &httptest.Server{
+		Listener: l,
+		Config:   &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	endpoint := srv.URL + "/stub_status"
+	if !strings.HasPrefix(endpoint, "http://[::1]:") {
+		t.Fatalf("server URL = %v, want a bracketed IPv6 address", endpoint)
+	}
+
+	for name, client := range map[string]*http.Client{
+		"default client": {},
+		"keep-alive":     NewHTTPClient(HTTPClientOpts{Timeout: time.Second, IdleConnTimeout: DefaultIdleConnTimeout}),
+		"h2c":            NewHTTPClient(HTTPClientOpts{Timeout: time.Second, H2C: true}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := GetStubStats(context.Background(), client, endpoint); err != nil {
+				t.Fatalf("GetStubStats() error = %v", err)
+			}
+		})
+	}
+
+	if got, want := InstanceName(endpoint), strings.TrimPrefix(srv.URL, "http://"); got != want {
+		t.Errorf("InstanceName() = %v, want %v", got, want)
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key to
+// files in a temporary directory, returning the certificate and the paths.
+func writeClientCert(t *testing.T) (cert *x509.Certificate, certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "custom-nginx-exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, certFile, keyFile
+}
+
+func TestGetStubStatsClientCertificate(t *testing.T) {
+	cert, certFile, keyFile := writeClientCert(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, validStubStatus)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	// Handshakes without a client certificate fail, which the server logs.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		opts    TLSOpts
+		wantErr bool
+	}{
+		{"with client certificate", TLSOpts{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, false},
+		{"without client certificate", TLSOpts{CAFile: caFile}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := NewTLSConfig(tt.opts)
+			if err != nil {
+				t.Fatalf("NewTLSConfig() error = %v", err)
+			}
+
+			client := NewHTTPClient(HTTPClientOpts{Timeout: time.Second, TLSConfig: tlsConfig})
+
+			_, err = GetStubStats(context.Background(), client, srv.URL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetStubStats() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigIncompleteClientCertificate(t *testing.T) {
+	_, certFile, keyFile := writeClientCert(t)
+
+	for _, opts := range []TLSOpts{{CertFile: certFile}, {KeyFile: keyFile}} {
+		if _, err := NewTLSConfig(opts); err == nil {
+			t.Errorf("NewTLSConfig(%+v) succeeded, want an error", opts)
+		}
+	}
+}
+
+func TestGetStubStatsProxy(t *testing.T) {
+	var proxied atomic.Value
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		io.WriteString(w, validStubStatus)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewHTTPClient(HTTPClientOpts{Timeout: time.Second, Proxy: proxyURL})
+
+	// The endpoint cannot be resolved, so it is only reached through the
+	// proxy.
+	const endpoint = "http://nginx.invalid/stub_status"
+
+	if _, err := GetStubStats(context.Background(), client, endpoint); err != nil {
+		t.Fatalf("GetStubStats() error = %v", err)
+	}
+	if got := proxied.Load(); got != endpoint {
+		t.Errorf("proxy received a request for %v, want %v", got, endpoint)
+	}
+}
+
+func TestGetStubStatsCanceled(t *testing.T) {
+	requested := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requested
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := GetStubStats(ctx, NewHTTPClient(HTTPClientOpts{Timeout: time.Minute}), srv.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetStubStats() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetStubStats() returned after %v, want it to return once canceled", elapsed)
+	}
+}
@@ -0,0 +1,829 @@
+// Package collector scrapes the status endpoints of NGINX, such as the
+// stub_status page, and exposes their metrics as a Prometheus collector. The
+// custom-nginx-exporter command is a thin wrapper around it, and it can be
+// embedded into applications serving their own metrics.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+// FetchStatsFunc fetches the NGINX metrics from a status endpoint.
+type FetchStatsFunc func(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+) (*StubStats, error)
+
+// CollectMetrics is a struct that collects metrics dynamically.
+type CollectMetrics struct {
+	metrics     *metrics
+	endpoints   []string
+	secondaries map[string]string
+	client      *http.Client
+	fetch       FetchStatsFunc
+	maxConns    int
+	workers     int
+	concurrency int
+	cacheTTL    time.Duration
+	minInterval time.Duration
+	cache       *ttlCache[*StubStats]
+	bodies      *ttlCache[[]byte]
+	flights     singleflight.Group
+
+	scrapeDuration *prometheus.HistogramVec
+	parseErrors    *prometheus.CounterVec
+	scrapeErrors   *prometheus.CounterVec
+	throttled      *prometheus.CounterVec
+	counterResets  *prometheus.CounterVec
+
+	disabled     map[*prometheus.Desc]bool
+	disabledVecs map[string]bool
+
+	detectResets bool
+	errorLog     *errorLog
+
+	mu           sync.Mutex
+	lastSuccess  map[string]time.Time
+	failures     map[string]int
+	lastRequests map[string]int64
+	lastAccepted map[string]counterChange
+}
+
+// counterChange is the value of a counter and the time it was last seen to
+// change.
+type counterChange struct {
+	value   int64
+	changed time.Time
+}
+
+// scrapeErrorStages lists the values of the reason label of the scrape errors
+// counter, along with the values of the stage label each of them occurs with.
+var scrapeErrorStages = map[string][]string{
+	"dns":          {"connect"},
+	"timeout":      {"connect", "read", "other"},
+	"connect":      {"connect"},
+	"rate_limited": {"status"},
+	"http_status":  {"status"},
+	"read":         {"read"},
+	"parse":        {"parse"},
+	"credentials":  {"credentials"},
+	"other":        {"request", "connect", "other"},
+}
+
+// scrapeErrorReason returns the reason label value for an error returned by
+// GetStubStats. Timeouts are reported as such whether they occur while
+// connecting or reading the response.
+func scrapeErrorReason(err error) string {
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+
+	switch {
+	case errors.Is(err, ErrCredentials):
+		return "credentials"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, ErrConnect):
+		return "connect"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrHTTPStatus):
+		return "http_status"
+	case errors.Is(err, ErrRead):
+		return "read"
+	case errors.Is(err, ErrParse):
+		return "parse"
+	default:
+		return "other"
+	}
+}
+
+// scrapeErrorStage returns the stage label value for an error returned by
+// GetStubStats, identifying whether creating the request, reading its
+// credentials, connecting, checking the response status, reading the body or
+// parsing it failed.
+func scrapeErrorStage(err error) string {
+	switch {
+	case errors.Is(err, ErrCredentials):
+		return "credentials"
+	case errors.Is(err, ErrRequest):
+		return "request"
+	case errors.Is(err, ErrConnect):
+		return "connect"
+	case errors.Is(err, ErrHTTPStatus):
+		return "status"
+	case errors.Is(err, ErrRead):
+		return "read"
+	case errors.Is(err, ErrParse):
+		return "parse"
+	default:
+		return "other"
+	}
+}
+
+// CollectorOpts configures a CollectMetrics.
+type CollectorOpts struct {
+	Metrics MetricsOpts
+
+	// Endpoints are the NGINX status endpoints to scrape.
+	Endpoints []string
+
+	// Client is used to fetch the metrics from the endpoints.
+	Client *http.Client
+
+	// Fetch fetches and parses the metrics of an endpoint.
+	Fetch FetchStatsFunc
+
+	// Secondaries maps endpoints to the endpoint scraped in their place when
+	// they cannot be scraped, such as another address of the same NGINX.
+	Secondaries map[string]string
+
+	// CacheTTL is how long fetched metrics are reused for. Zero disables
+	// caching.
+	CacheTTL time.Duration
+
+	// MinScrapeInterval is the minimum time between fetches of an endpoint,
+	// serving the metrics fetched last in between so that scraping too often
+	// does not load NGINX. Zero disables the limit.
+	MinScrapeInterval time.Duration
+
+	// DisabledMetrics are the names of metrics, without namespace and
+	// subsystem, that are neither described nor collected. Unknown names are
+	// ignored.
+	DisabledMetrics []string
+
+	// RecentErrors is the number of recent scrape errors kept for
+	// recentErrorsHandler. Zero keeps none.
+	RecentErrors int
+
+	// DetectCounterResets logs and counts decreases of the requests counter
+	// of an endpoint between scrapes, such as when NGINX restarts.
+	DetectCounterResets bool
+
+	// Concurrency is the maximum number of endpoints scraped at the same
+	// time, defaulting to GOMAXPROCS.
+	Concurrency int
+
+	// WorkerProcesses is the configured number of NGINX worker processes. If
+	// not zero, it is reported along with the active connections per worker.
+	WorkerProcesses int
+
+	// MaxConnections is the configured maximum number of connections, that
+	// is worker_connections times worker_processes. If not zero, the
+	// utilization of connections is reported.
+	MaxConnections int
+}
+
+// NewCollector creates a new instance of CollectMetrics and registers it with
+// reg, panicking if registration fails. Use NewCollectMetrics to register it
+// separately.
+func NewCollector(opts CollectorOpts, reg prometheus.Registerer) *CollectMetrics {
+	c := NewCollectMetrics(opts)
+	reg.MustRegister(c)
+	return c
+}
+
+// NewCollectMetrics creates a new instance of CollectMetrics without
+// registering it.
+func NewCollectMetrics(opts CollectorOpts) *CollectMetrics {
+	m := NewMetrics(opts.Metrics)
+	c := &CollectMetrics{
+		metrics:      m,
+		endpoints:    opts.Endpoints,
+		secondaries:  opts.Secondaries,
+		client:       opts.Client,
+		fetch:        opts.Fetch,
+		maxConns:     opts.MaxConnections,
+		workers:      opts.WorkerProcesses,
+		concurrency:  opts.Concurrency,
+		cacheTTL:     opts.CacheTTL,
+		minInterval:  opts.MinScrapeInterval,
+		lastSuccess:  make(map[string]time.Time),
+		failures:     make(map[string]int),
+		lastRequests: make(map[string]int64),
+		lastAccepted: make(map[string]counterChange),
+		detectResets: opts.DetectCounterResets,
+		scrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                       opts.Metrics.Namespace,
+			Subsystem:                       opts.Metrics.Subsystem,
+			Name:                            scrapeDurationMetric,
+			Help:                            opts.Metrics.help(scrapeDurationMetric, "Time taken to fetch and parse the NGINX status endpoint"),
+			ConstLabels:                     opts.Metrics.ConstLabels,
+			Buckets:                         opts.Metrics.ScrapeDurationBuckets,
+			NativeHistogramBucketFactor:     opts.Metrics.ScrapeDurationNativeBucketFactor,
+			NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+			NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+		}, []string{"instance"}),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Metrics.Namespace,
+			Subsystem:   opts.Metrics.Subsystem,
+			Name:        parseErrorsMetric,
+			Help:        opts.Metrics.help(parseErrorsMetric, "Total number of NGINX status responses that could not be parsed"),
+			ConstLabels: opts.Metrics.ConstLabels,
+		}, []string{"instance"}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Metrics.Namespace,
+			Subsystem:   opts.Metrics.Subsystem,
+			Name:        scrapeErrorsMetric,
+			Help:        opts.Metrics.help(scrapeErrorsMetric, "Total number of failed scrapes of the NGINX status endpoint by reason and stage"),
+			ConstLabels: opts.Metrics.ConstLabels,
+		}, []string{"instance", "reason", "stage"}),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Metrics.Namespace,
+			Subsystem:   opts.Metrics.Subsystem,
+			Name:        throttledMetric,
+			Help:        opts.Metrics.help(throttledMetric, "Total number of scrapes served from cache because the NGINX status endpoint was fetched less than the minimum scrape interval before"),
+			ConstLabels: opts.Metrics.ConstLabels,
+		}, []string{"instance"}),
+		counterResets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Metrics.Namespace,
+			Subsystem:   opts.Metrics.Subsystem,
+			Name:        counterResetsMetric,
+			Help:        opts.Metrics.help(counterResetsMetric, "Total number of times the requests counter of the NGINX status endpoint decreased between scrapes, such as when NGINX restarted"),
+			ConstLabels: opts.Metrics.ConstLabels,
+		}, []string{"instance"}),
+	}
+
+	if opts.RecentErrors > 0 {
+		c.errorLog = newErrorLog(opts.RecentErrors)
+	}
+
+	if c.concurrency <= 0 {
+		c.concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	if ttl := max(opts.CacheTTL, opts.MinScrapeInterval); ttl > 0 {
+		c.cache = newTTLCache[*StubStats](ttl)
+	}
+
+	if opts.MinScrapeInterval > 0 {
+		c.bodies = newTTLCache[[]byte](opts.MinScrapeInterval)
+	}
+
+	descs := m.descs()
+	c.disabled = make(map[*prometheus.Desc]bool)
+	c.disabledVecs = make(map[string]bool)
+
+	for _, name := range opts.DisabledMetrics {
+		if desc, ok := descs[name]; ok {
+			c.disabled[desc] = true
+		} else {
+			c.disabledVecs[name] = true
+		}
+	}
+
+	return c
+}
+
+// vecs returns the enabled metric vectors of c, which accumulate values
+// across scrapes.
+func (c *CollectMetrics) vecs() []prometheus.Collector {
+	var vecs []prometheus.Collector
+
+	for name, vec := range map[string]prometheus.Collector{
+		scrapeDurationMetric: c.scrapeDuration,
+		parseErrorsMetric:    c.parseErrors,
+		scrapeErrorsMetric:   c.scrapeErrors,
+		throttledMetric:      c.throttled,
+		counterResetsMetric:  c.counterResets,
+	} {
+		if !c.disabledVecs[name] {
+			vecs = append(vecs, vec)
+		}
+	}
+
+	return vecs
+}
+
+// Describe sends metric descriptions to the provided channel.
+func (c *CollectMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.metrics.descs() {
+		if !c.disabled[desc] {
+			ch <- desc
+		}
+	}
+
+	for _, vec := range c.vecs() {
+		vec.Describe(ch)
+	}
+}
+
+// Collect dynamically collects metrics and sends them to Prometheus.
+func (c *CollectMetrics) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch)
+}
+
+// WithContext returns a collector that collects the metrics of c, bounding
+// the scrapes of the NGINX status endpoints by ctx.
+func (c *CollectMetrics) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{c: c, ctx: ctx}
+}
+
+// collect scrapes every NGINX status endpoint, scraping up to the configured
+// concurrency of them at the same time.
+func (c *CollectMetrics) collect(
+	ctx context.Context,
+	ch chan<- prometheus.Metric,
+) {
+	var g errgroup.Group
+	g.SetLimit(c.concurrency)
+
+	for _, endpoint := range c.endpoints {
+		g.Go(func() error {
+			c.collectEndpoint(ctx, ch, endpoint)
+			return nil
+		})
+	}
+
+	g.Wait()
+
+	for _, vec := range c.vecs() {
+		vec.Collect(ch)
+	}
+}
+
+// send sends a constant metric to ch unless it is disabled.
+func (c *CollectMetrics) send(
+	ch chan<- prometheus.Metric,
+	desc *prometheus.Desc,
+	valueType prometheus.ValueType,
+	value float64,
+	labelValues ...string,
+) {
+	if !c.disabled[desc] {
+		ch <- prometheus.MustNewConstMetric(desc, valueType, value, labelValues...)
+	}
+}
+
+// sendCounter is like send for counters, attaching an exemplar with the labels
+// set by withExemplar on ctx, if any.
+func (c *CollectMetrics) sendCounter(
+	ctx context.Context,
+	ch chan<- prometheus.Metric,
+	desc *prometheus.Desc,
+	value float64,
+	labelValues ...string,
+) {
+	exemplar, ok := exemplarLabels(ctx)
+	if !ok || c.disabled[desc] {
+		c.send(ch, desc, prometheus.CounterValue, value, labelValues...)
+		return
+	}
+
+	ch <- prometheus.MustNewMetricWithExemplars(
+		prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labelValues...),
+		prometheus.Exemplar{Value: value, Labels: exemplar, Timestamp: time.Now()},
+	)
+}
+
+// collectEndpoint scrapes a single NGINX status endpoint and sends its
+// metrics labeled with the endpoint's instance name.
+func (c *CollectMetrics) collectEndpoint(
+	ctx context.Context,
+	ch chan<- prometheus.Metric,
+	endpoint string,
+) {
+	instance := InstanceName(endpoint)
+
+	c.send(ch, c.metrics.TargetInfoDesc, prometheus.GaugeValue, 1, instance, stripCredentials(endpoint))
+
+	start := time.Now()
+	nginxStats, cacheAge, servedBy, err := c.scrapeWithFailover(ctx, endpoint)
+	duration := time.Since(start).Seconds()
+
+	c.scrapeDuration.WithLabelValues(instance).Observe(duration)
+
+	// Counters are created before they are first incremented, so that every
+	// reason and stage is exported from the first scrape on.
+	parseErrors := c.parseErrors.WithLabelValues(instance)
+	for reason, stages := range scrapeErrorStages {
+		for _, stage := range stages {
+			c.scrapeErrors.WithLabelValues(instance, reason, stage)
+		}
+	}
+	if c.minInterval > 0 {
+		c.throttled.WithLabelValues(instance)
+	}
+	if c.detectResets {
+		c.counterResets.WithLabelValues(instance)
+	}
+
+	if errors.Is(err, ErrParse) {
+		parseErrors.Inc()
+	}
+	if err != nil {
+		c.scrapeErrors.WithLabelValues(instance, scrapeErrorReason(err), scrapeErrorStage(err)).Inc()
+	}
+
+	c.mu.Lock()
+	if err == nil {
+		c.lastSuccess[instance] = time.Now()
+		c.failures[instance] = 0
+	} else {
+		c.failures[instance]++
+	}
+	lastSuccess, succeeded := c.lastSuccess[instance]
+	failures := c.failures[instance]
+	c.mu.Unlock()
+
+	if succeeded {
+		c.send(ch, c.metrics.LastSuccessDesc, prometheus.GaugeValue, float64(lastSuccess.UnixNano())/1e9, instance)
+	}
+	c.send(ch, c.metrics.FailuresDesc, prometheus.GaugeValue, float64(failures), instance)
+
+	if err != nil {
+		attrs := []any{
+			"endpoint", RedactURL(servedBy),
+			"reason", scrapeErrorReason(err),
+			"stage", scrapeErrorStage(err),
+			"err", err,
+		}
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			attrs = append(attrs, "status_code", statusErr.Code)
+			if hint := statusErr.Hint(); hint != "" {
+				attrs = append(attrs, "hint", hint)
+			}
+		}
+
+		slog.Warn("failed to scrape NGINX status endpoint", attrs...)
+		if c.errorLog != nil {
+			c.errorLog.add(servedBy, err)
+		}
+		c.send(ch, c.metrics.UpDesc, prometheus.GaugeValue, 0, instance)
+		return
+	}
+
+	slog.Debug(
+		"scraped NGINX status endpoint",
+		"endpoint", RedactURL(servedBy),
+		"duration", duration,
+	)
+
+	c.send(ch, c.metrics.UpDesc, prometheus.GaugeValue, 1, instance)
+
+	if _, ok := c.secondaries[endpoint]; ok {
+		role := "primary"
+		if servedBy != endpoint {
+			role = "secondary"
+		}
+
+		c.send(ch, c.metrics.ServedByDesc, prometheus.GaugeValue, 1, instance, stripCredentials(servedBy), role)
+	}
+
+	if c.cache != nil {
+		c.send(ch, c.metrics.CacheAgeDesc, prometheus.GaugeValue, cacheAge.Seconds(), instance)
+	}
+
+	if c.detectResets && nginxStats.has("Requests") {
+		c.detectCounterReset(instance, nginxStats.Requests)
+	}
+
+	if nginxStats.has("Accepted") {
+		changed := c.acceptedChanged(instance, nginxStats.Connections.Accepted)
+		c.send(ch, c.metrics.AcceptedChangeDesc, prometheus.GaugeValue, float64(changed.UnixNano())/1e9, instance)
+	}
+
+	activeConnections := float64(nginxStats.Connections.Active)
+	connectionsReading := float64(nginxStats.Connections.Reading)
+	connectionsAccepted := float64(nginxStats.Connections.Accepted)
+	connectionsHandled := float64(nginxStats.Connections.Handled)
+	connectionsDropped := float64(droppedConnections(nginxStats.Connections))
+	connectionsWaiting := float64(nginxStats.Connections.Waiting)
+	connectionsWriting := float64(nginxStats.Connections.Writing)
+	httpRequestsTotal := float64(nginxStats.Requests)
+
+	// Metrics of fields missing from reduced output are not sent, rather
+	// than being reported as zero.
+	for _, m := range []struct {
+		fields    []string
+		desc      *prometheus.Desc
+		valueType prometheus.ValueType
+		value     float64
+	}{
+		{[]string{"Active"}, c.metrics.ActiveConnectionsDesc, prometheus.GaugeValue, activeConnections},
+		{[]string{"Reading"}, c.metrics.ConnectionsReadingDesc, prometheus.GaugeValue, connectionsReading},
+		{[]string{"Accepted"}, c.metrics.ConnectionsAcceptedDesc, prometheus.CounterValue, connectionsAccepted},
+		{[]string{"Handled"}, c.metrics.ConnectionsHandledDesc, prometheus.CounterValue, connectionsHandled},
+		{[]string{"Accepted", "Handled"}, c.metrics.ConnectionsDroppedDesc, prometheus.CounterValue, connectionsDropped},
+		{[]string{"Waiting"}, c.metrics.ConnectionsWaitingDesc, prometheus.GaugeValue, connectionsWaiting},
+		{[]string{"Writing"}, c.metrics.ConnectionsWritingDesc, prometheus.GaugeValue, connectionsWriting},
+		{[]string{"Requests"}, c.metrics.HTTPRequestsTotalDesc, prometheus.CounterValue, httpRequestsTotal},
+	} {
+		switch {
+		case slices.ContainsFunc(m.fields, func(f string) bool { return !nginxStats.has(f) }):
+		case m.valueType == prometheus.CounterValue:
+			c.sendCounter(ctx, ch, m.desc, m.value, instance)
+		default:
+			c.send(ch, m.desc, m.valueType, m.value, instance)
+		}
+	}
+
+	c.send(ch, c.metrics.ResponseBytesDesc, prometheus.GaugeValue, float64(nginxStats.ResponseBytes), instance)
+
+	if nginxStats.Version != "" {
+		c.send(ch, c.metrics.InfoDesc, prometheus.GaugeValue, 1, instance, nginxStats.Version)
+	}
+
+	if c.maxConns > 0 && nginxStats.has("Active") {
+		c.send(ch, c.metrics.ConnectionsUtilDesc, prometheus.GaugeValue, activeConnections/float64(c.maxConns), instance)
+	}
+
+	if c.workers > 0 {
+		c.send(ch, c.metrics.WorkerProcessesDesc, prometheus.GaugeValue, float64(c.workers), instance)
+		if nginxStats.has("Active") {
+			c.send(ch, c.metrics.ActivePerWorkerDesc, prometheus.GaugeValue, activeConnections/float64(c.workers), instance)
+		}
+	}
+
+	for name, zone := range nginxStats.ServerZones {
+		c.sendCounter(ctx, ch, c.metrics.ZoneRequestsDesc, float64(zone.Requests), instance, name)
+		c.sendCounter(ctx, ch, c.metrics.ZoneReceivedDesc, float64(zone.ReceivedBytes), instance, name)
+		c.sendCounter(ctx, ch, c.metrics.ZoneSentDesc, float64(zone.SentBytes), instance, name)
+		for class, responses := range zone.Responses {
+			c.sendCounter(ctx, ch, c.metrics.ZoneResponsesDesc, float64(responses), instance, name, class)
+		}
+	}
+}
+
+// detectCounterReset logs and counts a reset of the requests counter of
+// instance if it is below the value seen in the previous scrape. The value is
+// still exported as is, as Prometheus handles counter resets itself.
+func (c *CollectMetrics) detectCounterReset(instance string, requests int64) {
+	c.mu.Lock()
+	previous, seen := c.lastRequests[instance]
+	c.lastRequests[instance] = requests
+	c.mu.Unlock()
+
+	if seen && requests < previous {
+		c.counterResets.WithLabelValues(instance).Inc()
+		slog.Warn(
+			"requests counter of NGINX decreased, NGINX was probably restarted",
+			"instance", instance,
+			"previous", previous,
+			"current", requests,
+		)
+	}
+}
+
+// acceptedChanged records accepted as the accepted connections of instance,
+// returning the time they last changed. A NGINX accepting no connections
+// although it should be busy is likely stuck.
+func (c *CollectMetrics) acceptedChanged(instance string, accepted int64) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.lastAccepted[instance]
+	if !ok || last.value != accepted {
+		last = counterChange{value: accepted, changed: time.Now()}
+		c.lastAccepted[instance] = last
+	}
+
+	return last.changed
+}
+
+// droppedConnections returns the number of connections NGINX accepted but did
+// not handle, for example because worker_connections was exhausted. It is
+// clamped at zero, since a counter reset between reading the accepted and
+// handled counters could otherwise make it negative.
+func droppedConnections(c StubConnections) int64 {
+	return max(c.Accepted-c.Handled, 0)
+}
+
+// Endpoints returns the NGINX status endpoints scraped by c.
+func (c *CollectMetrics) Endpoints() []string {
+	return slices.Clone(c.endpoints)
+}
+
+// Concurrency returns the maximum number of endpoints scraped concurrently.
+func (c *CollectMetrics) Concurrency() int {
+	return c.concurrency
+}
+
+// RecentErrors returns the recent scrape errors kept by c, oldest first. None
+// are kept unless CollectorOpts.RecentErrors is set.
+func (c *CollectMetrics) RecentErrors() []ErrorLogEntry {
+	if c.errorLog == nil {
+		return []ErrorLogEntry{}
+	}
+
+	return c.errorLog.list()
+}
+
+// contextCollector collects the metrics of a CollectMetrics bound to a
+// context.
+type contextCollector struct {
+	c   *CollectMetrics
+	ctx context.Context
+}
+
+// Describe implements prometheus.Collector.
+func (cc *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	cc.c.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (cc *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.c.collect(cc.ctx, ch)
+}
+
+// scrapeWithFailover scrapes endpoint, scraping its secondary endpoint instead
+// if it fails and one is configured. It returns the endpoint that served the
+// metrics along with them, or the error of the last endpoint scraped.
+func (c *CollectMetrics) scrapeWithFailover(
+	ctx context.Context,
+	endpoint string,
+) (*StubStats, time.Duration, string, error) {
+	stats, age, err := c.Scrape(ctx, endpoint)
+
+	secondary, ok := c.secondaries[endpoint]
+	if err == nil || !ok {
+		return stats, age, endpoint, err
+	}
+
+	slog.Warn(
+		"failed to scrape NGINX status endpoint, trying its secondary",
+		"endpoint", RedactURL(endpoint),
+		"secondary", RedactURL(secondary),
+		"err", err,
+	)
+
+	stats, age, err = c.Scrape(ctx, secondary)
+
+	return stats, age, secondary, err
+}
+
+// Scrape returns the metrics of endpoint, reusing cached metrics if they are
+// still fresh, along with their age.
+func (c *CollectMetrics) Scrape(
+	ctx context.Context,
+	endpoint string,
+) (*StubStats, time.Duration, error) {
+	if c.cache != nil {
+		if stats, age, ok := c.cache.get(endpoint); ok {
+			// Metrics older than the cache time to live are only reused
+			// because of the minimum scrape interval.
+			if age >= c.cacheTTL {
+				c.throttled.WithLabelValues(InstanceName(endpoint)).Inc()
+			}
+
+			return stats, age, nil
+		}
+	}
+
+	// The scrape is abandoned once the client timeout expires, even if
+	// fetching hangs regardless of its context, such as in a custom dialer.
+	if c.client != nil && c.client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.client.Timeout)
+		defer cancel()
+	}
+
+	// Concurrent scrapes of the same endpoint share a single upstream request,
+	// bounded by the context of the scrape that started it.
+	v, err := c.shared(ctx, endpoint, endpoint, func() (any, error) {
+		scraper := Scraper{Endpoint: endpoint, Client: c.client, Fetch: c.fetch}
+
+		stats, err := scraper.Scrape(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.cache != nil {
+			c.cache.put(endpoint, stats)
+		}
+
+		return stats, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return v.(*StubStats), 0, nil
+}
+
+// StatusBody returns the raw body of the status endpoint, for example to
+// inspect a response that cannot be parsed. Like scrapes, concurrent calls
+// share a single upstream request, and with a minimum scrape interval, the
+// endpoint is fetched at most once per interval, reusing the body fetched
+// last in between.
+func (c *CollectMetrics) StatusBody(ctx context.Context, endpoint string) ([]byte, error) {
+	if c.bodies != nil {
+		if body, _, ok := c.bodies.get(endpoint); ok {
+			return body, nil
+		}
+	}
+
+	client := c.client
+	if client == nil {
+		client = defaultClient()
+	}
+
+	ctx, cancel := withClientTimeout(ctx, client)
+	defer cancel()
+
+	// Bodies are not shared with scrapes, so their key cannot be an endpoint.
+	v, err := c.shared(ctx, "body "+endpoint, endpoint, func() (any, error) {
+		body, _, err := GetStatusBody(ctx, client, endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.bodies != nil {
+			c.bodies.put(endpoint, body)
+		}
+
+		return body, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+// shared calls fetch for endpoint, unless a call for the same key is already
+// in flight, in which case its result is shared. It gives up waiting for the
+// result once ctx is done.
+func (c *CollectMetrics) shared(
+	ctx context.Context,
+	key string,
+	endpoint string,
+	fetch func() (any, error),
+) (any, error) {
+	flight := c.flights.DoChan(key, fetch)
+
+	select {
+	case res := <-flight:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		// A fetch ignoring its context may never return, so later calls
+		// start a new one rather than waiting for it too.
+		c.flights.Forget(key)
+
+		return nil, fmt.Errorf(
+			"gave up waiting for %v: %w",
+			RedactURL(endpoint),
+			ctx.Err(),
+		)
+	}
+}
+
+// exemplarKey is the context key of the labels of the exemplars attached to
+// counters.
+type exemplarKey struct{}
+
+// withExemplar returns a copy of ctx in which counters collected by
+// CollectMetrics carry an exemplar with labels.
+func withExemplar(ctx context.Context, labels prometheus.Labels) context.Context {
+	return context.WithValue(ctx, exemplarKey{}, labels)
+}
+
+// exemplarLabels returns the labels of the exemplars set by withExemplar.
+func exemplarLabels(ctx context.Context) (prometheus.Labels, bool) {
+	labels, ok := ctx.Value(exemplarKey{}).(prometheus.Labels)
+	return labels, ok
+}
+
+// InstanceName returns the value of the instance label for endpoint, which is
+// the host and port of the endpoint if it can be determined.
+func InstanceName(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+
+	return u.Host
+}
+
+// stripCredentials removes the username and password from endpoint.
+func stripCredentials(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return RedactURL(endpoint)
+	}
+
+	u.User = nil
+
+	return u.String()
+}
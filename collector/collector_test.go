@@ -0,0 +1,685 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMain(m *testing.M) {
+	// Scrape failures are expected in tests and would only clutter the
+	// output.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	os.Exit(m.Run())
+}
+
+// hangingFetch returns a FetchStatsFunc that ignores its context and blocks
+// until release is closed, counting its calls in calls.
+func hangingFetch(calls *atomic.Int32, release <-chan struct{}) FetchStatsFunc {
+	return func(context.Context, *http.Client, string) (*StubStats, error) {
+		calls.Add(1)
+		<-release
+		return &StubStats{}, nil
+	}
+}
+
+func TestCollectHangingFetch(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+
+	const timeout = 100 * time.Millisecond
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{"http://127.0.0.1/stub_status"},
+		Client:    &http.Client{Timeout: timeout},
+		Fetch:     hangingFetch(&calls, release),
+	})
+
+	for i := range 3 {
+		start := time.Now()
+		up, ok := gather(t, c)[`nginx_up{instance="127.0.0.1"}`]
+		if elapsed := time.Since(start); elapsed > 5*timeout {
+			t.Fatalf("scrape %d: Collect returned after %v, want about %v", i, elapsed, timeout)
+		}
+		if !ok || up != 0 {
+			t.Errorf("scrape %d: nginx_up = %v, %v, want 0", i, up, ok)
+		}
+	}
+
+	// Every scrape starts its own fetch instead of waiting for the one that
+	// hangs.
+	if got := calls.Load(); got != 3 {
+		t.Errorf("fetched %d times, want 3", got)
+	}
+}
+
+// gather collects c and returns the values of its metrics keyed by their
+// names and labels, such as nginx_up{instance="127.0.0.1"}, with labels
+// sorted by name.
+func gather(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+
+	values := make(map[string]float64)
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make([]string, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%v=%q", l.GetName(), l.GetValue()))
+			}
+
+			key := mf.GetName() + "{" + strings.Join(labels, ",") + "}"
+
+			switch {
+			case m.GetGauge() != nil:
+				values[key] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[key] = m.GetCounter().GetValue()
+			case m.GetUntyped() != nil:
+				values[key] = m.GetUntyped().GetValue()
+			case m.GetHistogram() != nil:
+				values[key] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return values
+}
+
+// stubServer starts a server responding to every request with body, or with
+// a 500 Internal Server Error if body is empty.
+func stubServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestCollectFailover(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		primary       string
+		secondary     string
+		wantUp        float64
+		wantSecondary bool
+	}{
+		{"primary up", validStubStatus, validStubStatus, 1, false},
+		{"primary down, secondary up", "", validStubStatus, 1, true},
+		{"both down", "", "", 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := stubServer(t, tt.primary)
+			secondary := stubServer(t, tt.secondary)
+
+			c := NewCollectMetrics(CollectorOpts{
+				Metrics:     MetricsOpts{Namespace: "nginx"},
+				Endpoints:   []string{primary.URL},
+				Secondaries: map[string]string{primary.URL: secondary.URL},
+			})
+
+			values := gather(t, c)
+			instance := InstanceName(primary.URL)
+
+			if got := values[fmt.Sprintf("nginx_up{instance=%q}", instance)]; got != tt.wantUp {
+				t.Errorf("nginx_up = %v, want %v", got, tt.wantUp)
+			}
+
+			servedBy := map[string]float64{}
+			for key, v := range values {
+				if strings.HasPrefix(key, "nginx_exporter_served_by_info{") {
+					servedBy[key] = v
+				}
+			}
+
+			want := map[string]float64{}
+			if tt.wantUp == 1 {
+				endpoint, role := primary.URL, "primary"
+				if tt.wantSecondary {
+					endpoint, role = secondary.URL, "secondary"
+				}
+
+				want[fmt.Sprintf(
+					"nginx_exporter_served_by_info{endpoint=%q,instance=%q,role=%q}",
+					endpoint,
+					instance,
+					role,
+				)] = 1
+			}
+
+			if !maps.Equal(servedBy, want) {
+				t.Errorf("served by = %v, want %v", servedBy, want)
+			}
+		})
+	}
+}
+
+func TestStatusBodyMinScrapeInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		minInterval time.Duration
+		wantCalls   int32
+	}{
+		{"disabled", 0, 3},
+		{"enabled", time.Minute, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				io.WriteString(w, validStubStatus)
+			}))
+			t.Cleanup(srv.Close)
+
+			c := NewCollectMetrics(CollectorOpts{
+				Metrics:           MetricsOpts{Namespace: "nginx"},
+				Endpoints:         []string{srv.URL},
+				MinScrapeInterval: tt.minInterval,
+			})
+
+			for range 3 {
+				body, err := c.StatusBody(context.Background(), srv.URL)
+				if err != nil {
+					t.Fatalf("StatusBody() error = %v", err)
+				}
+				if string(body) != validStubStatus {
+					t.Errorf("StatusBody() = %q, want %q", body, validStubStatus)
+				}
+			}
+
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream requests = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCollectConcurrentScrapesShareFetch(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{"http://127.0.0.1/stub_status"},
+		Fetch:     hangingFetch(&calls, release),
+	})
+
+	const n = 10
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ch := make(chan prometheus.Metric)
+			go func() {
+				c.Collect(ch)
+				close(ch)
+			}()
+			for range ch {
+			}
+		}()
+	}
+
+	// The first fetch is held until every Collect has had time to join it.
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("fetched %d times for %d concurrent Collects, want 1", got, n)
+	}
+}
+
+func TestDroppedConnections(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		accepted int64
+		handled  int64
+		want     int64
+	}{
+		{"none dropped", 10, 10, 0},
+		{"some dropped", 10, 7, 3},
+		// After a reset between reading the counters, handled may exceed
+		// accepted.
+		{"reset between counters", 2, 10, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := droppedConnections(StubConnections{Accepted: tt.accepted, Handled: tt.handled})
+			if got != tt.want {
+				t.Errorf("droppedConnections() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectDroppedConnections(t *testing.T) {
+	srv := stubServer(t, "Active connections: 1\nserver accepts handled requests\n 10 7 20\nReading: 0 Writing: 1 Waiting: 0\n")
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{srv.URL},
+	})
+
+	key := fmt.Sprintf("nginx_connections_dropped_total{instance=%q}", InstanceName(srv.URL))
+	if got := gather(t, c)[key]; got != 3 {
+		t.Errorf("%v = %v, want 3", key, got)
+	}
+}
+
+func TestCollectScrapeDuration(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics: MetricsOpts{
+			Namespace:                        "nginx",
+			ScrapeDurationBuckets:            []float64{0.01, 10},
+			ScrapeDurationNativeBucketFactor: DefaultNativeHistogramBucketFactor,
+		},
+		Endpoints: []string{"http://127.0.0.1/stub_status"},
+		Fetch: func(context.Context, *http.Client, string) (*StubStats, error) {
+			time.Sleep(delay)
+			return &StubStats{}, nil
+		},
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	var h *dto.Histogram
+	for range 2 {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Gather() error = %v", err)
+		}
+
+		for _, mf := range mfs {
+			if mf.GetName() == "nginx_scrape_duration_seconds" {
+				h = mf.GetMetric()[0].GetHistogram()
+			}
+		}
+	}
+
+	if h == nil {
+		t.Fatal("nginx_scrape_duration_seconds not exported")
+	}
+
+	if got := h.GetSampleCount(); got != 2 {
+		t.Errorf("sample count = %v, want 2", got)
+	}
+	if got := h.GetSampleSum(); got < 2*delay.Seconds() {
+		t.Errorf("sample sum = %v, want at least %v", got, 2*delay.Seconds())
+	}
+
+	buckets := h.GetBucket()
+	if len(buckets) != 2 || buckets[0].GetCumulativeCount() != 0 || buckets[1].GetCumulativeCount() != 2 {
+		t.Errorf("buckets = %v, want both durations between 0.01 and 10", buckets)
+	}
+
+	// Native histograms have a schema and their observations in spans.
+	if h.Schema == nil || len(h.GetPositiveSpan()) == 0 {
+		t.Errorf("histogram = %v, want a native histogram", h)
+	}
+}
+
+func TestCollectConnectionsUtilization(t *testing.T) {
+	// 291 active connections, as in validStubStatus.
+	for _, tt := range []struct {
+		name           string
+		maxConnections int
+		want           float64
+		wantExported   bool
+	}{
+		{"not configured", 0, 0, false},
+		{"configured", 1000, 0.291, true},
+		{"exhausted", 291, 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := stubServer(t, validStubStatus)
+
+			c := NewCollectMetrics(CollectorOpts{
+				Metrics:        MetricsOpts{Namespace: "nginx"},
+				Endpoints:      []string{srv.URL},
+				MaxConnections: tt.maxConnections,
+			})
+
+			key := fmt.Sprintf("nginx_connections_utilization_ratio{instance=%q}", InstanceName(srv.URL))
+
+			got, ok := gather(t, c)[key]
+			if ok != tt.wantExported || got != tt.want {
+				t.Errorf("%v = %v, exported %v, want %v, exported %v", key, got, ok, tt.want, tt.wantExported)
+			}
+		})
+	}
+}
+
+// scrapeErrors collects c and returns the non-zero values of its scrape
+// errors counter keyed by their reason and stage, such as timeout/read.
+func scrapeErrors(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+
+	re := regexp.MustCompile(`^nginx_scrape_errors_total\{instance="[^"]*",reason="([^"]*)",stage="([^"]*)"\}$`)
+
+	errs := make(map[string]float64)
+	for key, v := range gather(t, c) {
+		if m := re.FindStringSubmatch(key); m != nil && v > 0 {
+			errs[m[1]+"/"+m[2]] = v
+		}
+	}
+
+	return errs
+}
+
+func TestCollectTimeoutReason(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{srv.URL},
+		Client:    NewHTTPClient(HTTPClientOpts{Timeout: 50 * time.Millisecond}),
+	})
+
+	// Depending on whether the client or the scrape gives up first, the
+	// stage is connect or other.
+	errs := scrapeErrors(t, c)
+	if len(errs) != 1 || errs["timeout/connect"]+errs["timeout/other"] != 1 {
+		t.Errorf("scrape errors = %v, want a single timeout", errs)
+	}
+}
+
+func TestScrapeErrorReasonDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	srv := stubServer(t, validStubStatus)
+
+	_, err := GetStubStats(ctx, &http.Client{}, srv.URL)
+	if got := scrapeErrorReason(err); got != "timeout" {
+		t.Errorf("scrapeErrorReason(%v) = %v, want timeout", err, got)
+	}
+}
+
+func TestCollectDNSReason(t *testing.T) {
+	// The .invalid top-level domain is guaranteed not to resolve.
+	const endpoint = "http://nginx.invalid/stub_status"
+
+	_, err := GetStubStats(context.Background(), NewHTTPClient(HTTPClientOpts{Timeout: 5 * time.Second}), endpoint)
+	if !errors.Is(err, ErrConnect) || !strings.Contains(err.Error(), "DNS lookup failed for host nginx.invalid") {
+		t.Fatalf("GetStubStats() error = %v, want a DNS lookup failure", err)
+	}
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{endpoint},
+		Client:    NewHTTPClient(HTTPClientOpts{Timeout: 5 * time.Second}),
+	})
+
+	if errs := scrapeErrors(t, c); len(errs) != 1 || errs["dns/connect"] != 1 {
+		t.Errorf("scrape errors = %v, want a single DNS failure", errs)
+	}
+}
+
+func TestCollectRateLimited(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	_, err := GetStubStats(context.Background(), &http.Client{}, srv.URL)
+
+	var statusErr *StatusError
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &statusErr) {
+		t.Fatalf("GetStubStats() error = %v, want ErrRateLimited", err)
+	}
+	if statusErr.RetryAfter != 2*time.Second {
+		t.Errorf("RetryAfter = %v, want 2s", statusErr.RetryAfter)
+	}
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{srv.URL},
+	})
+
+	if errs := scrapeErrors(t, c); len(errs) != 1 || errs["rate_limited/status"] != 1 {
+		t.Errorf("scrape errors = %v, want a single rate limited scrape", errs)
+	}
+}
+
+func TestCollectCredentialsError(t *testing.T) {
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{"http://127.0.0.1/stub_status"},
+		Fetch: func(context.Context, *http.Client, string) (*StubStats, error) {
+			return nil, fmt.Errorf("error getting http://127.0.0.1/stub_status: %w: %w", ErrCredentials, os.ErrNotExist)
+		},
+	})
+
+	if errs := scrapeErrors(t, c); len(errs) != 1 || errs["credentials/credentials"] != 1 {
+		t.Errorf("scrape errors = %v, want a single credentials error", errs)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, true},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			h := http.Header{}
+			if tt.value != "" {
+				h.Set("Retry-After", tt.value)
+			}
+
+			got, ok := RetryAfter(h)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("RetryAfter() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	// Dates are relative to now.
+	h := http.Header{"Retry-After": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}
+	if got, ok := RetryAfter(h); !ok || got < 58*time.Minute || got > time.Hour {
+		t.Errorf("RetryAfter() = %v, %v, want about an hour", got, ok)
+	}
+}
+
+func TestCollectConcurrency(t *testing.T) {
+	const (
+		delay     = 100 * time.Millisecond
+		endpoints = 4
+	)
+
+	for _, tt := range []struct {
+		concurrency int
+		min, max    time.Duration
+	}{
+		// Concurrent scrapes take less time than scraping one endpoint after
+		// the other.
+		{1, endpoints * delay, 10 * endpoints * delay},
+		{2, endpoints / 2 * delay, endpoints * delay},
+		{endpoints, delay, endpoints * delay},
+	} {
+		t.Run(fmt.Sprint(tt.concurrency), func(t *testing.T) {
+			var inFlight, maxInFlight atomic.Int32
+
+			opts := CollectorOpts{
+				Metrics:     MetricsOpts{Namespace: "nginx"},
+				Concurrency: tt.concurrency,
+				Fetch: func(context.Context, *http.Client, string) (*StubStats, error) {
+					n := inFlight.Add(1)
+					defer inFlight.Add(-1)
+
+					for {
+						m := maxInFlight.Load()
+						if n <= m || maxInFlight.CompareAndSwap(m, n) {
+							break
+						}
+					}
+
+					time.Sleep(delay)
+					return &StubStats{}, nil
+				},
+			}
+			for i := range endpoints {
+				opts.Endpoints = append(opts.Endpoints, fmt.Sprintf("http://10.0.0.%d/stub_status", i+1))
+			}
+
+			c := NewCollectMetrics(opts)
+
+			start := time.Now()
+			values := gather(t, c)
+			elapsed := time.Since(start)
+
+			if elapsed < tt.min || elapsed >= tt.max {
+				t.Errorf("Collect took %v, want between %v and %v", elapsed, tt.min, tt.max)
+			}
+			if got := maxInFlight.Load(); got != int32(tt.concurrency) {
+				t.Errorf("%d endpoints scraped at the same time, want %d", got, tt.concurrency)
+			}
+
+			for i := range endpoints {
+				key := fmt.Sprintf(`nginx_up{instance="10.0.0.%d"}`, i+1)
+				if values[key] != 1 {
+					t.Errorf("%v = %v, want 1", key, values[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCollectAcceptedLastChange(t *testing.T) {
+	var accepted atomic.Int64
+	accepted.Store(1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Active connections: 1\nserver accepts handled requests\n %d %[1]d 1\nReading: 0 Writing: 1 Waiting: 0\n", accepted.Load())
+	}))
+	defer srv.Close()
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{srv.URL},
+	})
+
+	key := fmt.Sprintf("nginx_connections_accepted_last_change_seconds{instance=%q}", InstanceName(srv.URL))
+	lastChange := func() float64 {
+		t.Helper()
+
+		v, ok := gather(t, c)[key]
+		if !ok {
+			t.Fatalf("%v not exported", key)
+		}
+		return v
+	}
+
+	start := float64(time.Now().UnixNano()) / 1e9
+
+	first := lastChange()
+	if first < start {
+		t.Errorf("first scrape: %v = %v, want the time of the scrape", key, first)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if got := lastChange(); got != first {
+		t.Errorf("unchanged counter: %v = %v, want %v", key, got, first)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	accepted.Add(1)
+	if got := lastChange(); got <= first {
+		t.Errorf("changed counter: %v = %v, want after %v", key, got, first)
+	}
+}
+
+func TestCollectConsecutiveFailures(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, validStubStatus)
+	}))
+	defer srv.Close()
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{srv.URL},
+	})
+
+	key := fmt.Sprintf("nginx_consecutive_scrape_failures{instance=%q}", InstanceName(srv.URL))
+	for i, tt := range []struct {
+		down bool
+		want float64
+	}{
+		{false, 0},
+		{true, 1},
+		{true, 2},
+		{true, 3},
+		{false, 0},
+		{true, 1},
+	} {
+		down.Store(tt.down)
+		if got := gather(t, c)[key]; got != tt.want {
+			t.Errorf("scrape %d (down %v): %v = %v, want %v", i, tt.down, key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+// errorLog holds the most recent scrape errors in a ring buffer of fixed
+// size, so that intermittent failures can be inspected after the fact. It is
+// safe for concurrent use.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []ErrorLogEntry
+	next    int
+	full    bool
+}
+
+// ErrorLogEntry is a scrape error held by an errorLog.
+type ErrorLogEntry struct {
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	Error    string    `json:"error"`
+}
+
+// newErrorLog creates an errorLog holding up to size errors.
+func newErrorLog(size int) *errorLog {
+	return &errorLog{entries: make([]ErrorLogEntry, size)}
+}
+
+// add records err as a failure to scrape endpoint, replacing the oldest
+// error once the log is full.
+func (l *errorLog) add(endpoint string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = ErrorLogEntry{
+		Time:     time.Now(),
+		Endpoint: RedactURL(endpoint),
+		Error:    err.Error(),
+	}
+
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the recorded errors, oldest first.
+func (l *errorLog) list() []ErrorLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]ErrorLogEntry{}, l.entries[:l.next]...)
+	}
+
+	return append(
+		append([]ErrorLogEntry{}, l.entries[l.next:]...),
+		l.entries[:l.next]...,
+	)
+}
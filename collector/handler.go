@@ -0,0 +1,112 @@
+package collector
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeTimeoutOffset is subtracted from the scrape timeout announced by
+// Prometheus to leave time for rendering the response.
+const scrapeTimeoutOffset = 250 * time.Millisecond
+
+// MetricsHandler serves the metrics gathered from gatherer along with those
+// collected by c. The scrapes of the NGINX status endpoints are bound to the
+// request and to the scrape timeout announced by Prometheus, if any. If the
+// request carries a trace context, the counters of the NGINX metrics carry an
+// exemplar with its trace ID.
+func MetricsHandler(
+	c *CollectMetrics,
+	gatherer prometheus.Gatherer,
+	opts promhttp.HandlerOpts,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if timeout, ok := PrometheusScrapeTimeout(r); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		if id, ok := traceID(r); ok {
+			ctx = withExemplar(ctx, prometheus.Labels{"trace_id": id})
+		}
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.WithContext(ctx))
+
+		promhttp.HandlerFor(
+			prometheus.Gatherers{gatherer, reg},
+			opts,
+		).ServeHTTP(w, r)
+	})
+}
+
+// Register creates a collector scraping the NGINX status endpoints of opts,
+// registers it with reg and serves the metrics of reg under path on mux. It
+// allows embedding the exporter into an application that has its own
+// registry and mux, and returns the error of reg.Register if the collector
+// cannot be registered, such as when reg already holds its metrics. As the
+// collector is gathered with the rest of reg, its scrapes are not bound to
+// the requests for path; use MetricsHandler for that.
+func Register(
+	mux *http.ServeMux,
+	path string,
+	reg *prometheus.Registry,
+	opts CollectorOpts,
+) (*CollectMetrics, error) {
+	c := NewCollectMetrics(opts)
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+
+	mux.Handle(path, promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+
+	return c, nil
+}
+
+// PrometheusScrapeTimeout returns the scrape timeout sent by Prometheus in
+// the X-Prometheus-Scrape-Timeout-Seconds header, reduced by
+// scrapeTimeoutOffset to leave time for rendering the response.
+func PrometheusScrapeTimeout(r *http.Request) (time.Duration, bool) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+
+	return timeout, true
+}
+
+// traceID returns the trace ID of the W3C traceparent header of r, such as
+// 4bf92f3577b34da6a3ce929d0e0e4736 for
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func traceID(r *http.Request) (string, bool) {
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 {
+		return "", false
+	}
+
+	id := parts[1]
+	if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+		return "", false
+	}
+
+	return strings.ToLower(id), true
+}
@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRegister(t *testing.T) {
+	nginx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, validStubStatus)
+	}))
+	defer nginx.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "app_requests_total",
+		Help: "Requests served by the application",
+	}))
+
+	opts := CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{nginx.URL},
+	}
+
+	mux := http.NewServeMux()
+	if _, err := Register(mux, "/metrics", reg, opts); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"app_requests_total 0",
+		`nginx_up{instance="` + strings.TrimPrefix(nginx.URL, "http://") + `"} 1`,
+		`nginx_http_requests_total{instance="` + strings.TrimPrefix(nginx.URL, "http://") + `"} 3.1070465e+07`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%v", want, body)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if !slices.ContainsFunc(families, func(mf *dto.MetricFamily) bool {
+		return mf.GetName() == "nginx_up"
+	}) {
+		t.Error("Gather() does not return nginx_up, want the collector registered with reg")
+	}
+
+	if _, err := Register(http.NewServeMux(), "/metrics", reg, opts); err == nil {
+		t.Error("Register() twice with the same registry succeeded, want an error")
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	nginx := stubServer(t, validStubStatus)
+
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{nginx.URL},
+	})
+	handler := MetricsHandler(c, prometheus.Gatherers{}, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+	for _, tt := range []struct {
+		accept   string
+		wantType string
+		wantEOF  bool
+	}{
+		{"application/openmetrics-text; version=1.0.0", "application/openmetrics-text", true},
+		{"text/plain", "text/plain", false},
+	} {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", tt.accept)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %v", got, tt.wantType)
+			}
+
+			body := rec.Body.String()
+			if got := strings.HasSuffix(body, "# EOF\n"); got != tt.wantEOF {
+				t.Errorf("body ends with # EOF = %v, want %v", got, tt.wantEOF)
+			}
+			if tt.wantEOF && !strings.Contains(body, "# TYPE nginx_http_requests counter") {
+				t.Errorf("body does not declare nginx_http_requests as an OpenMetrics counter:\n%v", body)
+			}
+		})
+	}
+}
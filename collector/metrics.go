@@ -0,0 +1,281 @@
+package collector
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNativeHistogramBucketFactor is the bucket factor of the native scrape
+// duration histogram used by the exporter when SCRAPE_DURATION_NATIVE_FACTOR
+// is unset.
+const DefaultNativeHistogramBucketFactor = 1.1
+
+// Limits of the native scrape duration histogram, resetting it once it has
+// too many buckets.
+const (
+	nativeHistogramMaxBucketNumber  = 100
+	nativeHistogramMinResetDuration = time.Hour
+)
+
+// Metrics holds descriptions for NGINX-related metrics.
+type metrics struct {
+	UpDesc                  *prometheus.Desc
+	CacheAgeDesc            *prometheus.Desc
+	LastSuccessDesc         *prometheus.Desc
+	FailuresDesc            *prometheus.Desc
+	ActiveConnectionsDesc   *prometheus.Desc
+	ConnectionsReadingDesc  *prometheus.Desc
+	ConnectionsAcceptedDesc *prometheus.Desc
+	ConnectionsHandledDesc  *prometheus.Desc
+	ConnectionsDroppedDesc  *prometheus.Desc
+	ConnectionsWaitingDesc  *prometheus.Desc
+	ConnectionsWritingDesc  *prometheus.Desc
+	ConnectionsUtilDesc     *prometheus.Desc
+	HTTPRequestsTotalDesc   *prometheus.Desc
+	ResponseBytesDesc       *prometheus.Desc
+	TargetInfoDesc          *prometheus.Desc
+	ServedByDesc            *prometheus.Desc
+	InfoDesc                *prometheus.Desc
+	AcceptedChangeDesc      *prometheus.Desc
+	WorkerProcessesDesc     *prometheus.Desc
+	ActivePerWorkerDesc     *prometheus.Desc
+	ZoneRequestsDesc        *prometheus.Desc
+	ZoneResponsesDesc       *prometheus.Desc
+	ZoneReceivedDesc        *prometheus.Desc
+	ZoneSentDesc            *prometheus.Desc
+}
+
+// MetricsOpts holds the options shared by all NGINX-related metrics.
+type MetricsOpts struct {
+	// Namespace and, if not empty, Subsystem are prefixed to metric names.
+	Namespace string
+	Subsystem string
+
+	// ConstLabels are added to every metric.
+	ConstLabels prometheus.Labels
+
+	// ScrapeDurationBuckets are the buckets of the scrape duration histogram,
+	// defaulting to prometheus.DefBuckets.
+	ScrapeDurationBuckets []float64
+
+	// ScrapeDurationNativeBucketFactor enables a native histogram for the
+	// scrape duration if greater than one. See
+	// prometheus.HistogramOpts.NativeHistogramBucketFactor.
+	ScrapeDurationNativeBucketFactor float64
+
+	// Help overrides the help strings of metrics, keyed by metric name without
+	// namespace and subsystem.
+	Help map[string]string
+}
+
+// help returns the help string of the metric name, which is fallback unless
+// it is overridden.
+func (o MetricsOpts) help(name, fallback string) string {
+	if h := o.Help[name]; h != "" {
+		return h
+	}
+
+	return fallback
+}
+
+// Names of the metrics of CollectMetrics that are not constant metrics and
+// so have no description in metrics.
+const (
+	scrapeDurationMetric = "scrape_duration_seconds"
+	parseErrorsMetric    = "parse_errors_total"
+	scrapeErrorsMetric   = "scrape_errors_total"
+	throttledMetric      = "scrapes_throttled_total"
+	counterResetsMetric  = "counter_resets_total"
+)
+
+// descs returns the metric descriptions by metric name, without namespace and
+// subsystem.
+func (m *metrics) descs() map[string]*prometheus.Desc {
+	return map[string]*prometheus.Desc{
+		"up":                                       m.UpDesc,
+		"scrape_cache_age_seconds":                 m.CacheAgeDesc,
+		"last_scrape_success_timestamp_seconds":    m.LastSuccessDesc,
+		"consecutive_scrape_failures":              m.FailuresDesc,
+		"connections_active":                       m.ActiveConnectionsDesc,
+		"connections_reading":                      m.ConnectionsReadingDesc,
+		"connections_accepted_total":               m.ConnectionsAcceptedDesc,
+		"connections_handled_total":                m.ConnectionsHandledDesc,
+		"connections_dropped_total":                m.ConnectionsDroppedDesc,
+		"connections_waiting":                      m.ConnectionsWaitingDesc,
+		"connections_writing":                      m.ConnectionsWritingDesc,
+		"connections_utilization_ratio":            m.ConnectionsUtilDesc,
+		"http_requests_total":                      m.HTTPRequestsTotalDesc,
+		"status_response_bytes":                    m.ResponseBytesDesc,
+		"exporter_target_info":                     m.TargetInfoDesc,
+		"exporter_served_by_info":                  m.ServedByDesc,
+		"info":                                     m.InfoDesc,
+		"connections_accepted_last_change_seconds": m.AcceptedChangeDesc,
+		"worker_processes":                         m.WorkerProcessesDesc,
+		"connections_active_per_worker":            m.ActivePerWorkerDesc,
+		"server_zone_requests_total":               m.ZoneRequestsDesc,
+		"server_zone_responses_total":              m.ZoneResponsesDesc,
+		"server_zone_received_bytes_total":         m.ZoneReceivedDesc,
+		"server_zone_sent_bytes_total":             m.ZoneSentDesc,
+	}
+}
+
+// MetricNames returns the sorted names of the metrics of CollectMetrics,
+// without namespace and subsystem.
+func MetricNames() []string {
+	names := slices.Collect(maps.Keys(NewMetrics(MetricsOpts{}).descs()))
+	names = append(names, scrapeDurationMetric, parseErrorsMetric, scrapeErrorsMetric, throttledMetric, counterResetsMetric)
+	slices.Sort(names)
+
+	return names
+}
+
+// ParseMetricNames parses a comma-separated list of metric names, without
+// namespace and subsystem, returning the known and unknown ones.
+func ParseMetricNames(s string) (known, unknown []string) {
+	names := MetricNames()
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case slices.Contains(names, name):
+			known = append(known, name)
+		default:
+			unknown = append(unknown, name)
+		}
+	}
+
+	return known, unknown
+}
+
+// NewMetrics initializes all metric descriptions.
+func NewMetrics(opts MetricsOpts) *metrics {
+	labels := []string{"instance"}
+
+	return &metrics{
+		UpDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "up"),
+			opts.help("up", "Whether the last scrape of the NGINX status endpoint was successful"),
+			labels, opts.ConstLabels,
+		),
+		CacheAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "scrape_cache_age_seconds"),
+			opts.help("scrape_cache_age_seconds", "Age of the cached NGINX metrics served by the last scrape"),
+			labels, opts.ConstLabels,
+		),
+		LastSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "last_scrape_success_timestamp_seconds"),
+			opts.help("last_scrape_success_timestamp_seconds", "Unix time of the last successful scrape of the NGINX status endpoint"),
+			labels, opts.ConstLabels,
+		),
+		FailuresDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "consecutive_scrape_failures"),
+			opts.help("consecutive_scrape_failures", "Number of scrapes of the NGINX status endpoint that failed since the last successful one"),
+			labels, opts.ConstLabels,
+		),
+		ActiveConnectionsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_active"),
+			opts.help("connections_active", "Active client connections"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsReadingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_reading"),
+			opts.help("connections_reading", "Connections currently reading client request headers"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsAcceptedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_accepted_total"),
+			opts.help("connections_accepted_total", "Total accepted client connections"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsHandledDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_handled_total"),
+			opts.help("connections_handled_total", "Total handled client connections"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsDroppedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_dropped_total"),
+			opts.help("connections_dropped_total", "Total dropped client connections, computed as accepted minus handled connections"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsWaitingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_waiting"),
+			opts.help("connections_waiting", "Idle client connections"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsWritingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_writing"),
+			opts.help("connections_writing", "Connections where NGINX is currently writing responses to clients"),
+			labels, opts.ConstLabels,
+		),
+		ConnectionsUtilDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_utilization_ratio"),
+			opts.help("connections_utilization_ratio", "Active client connections divided by the configured maximum number of connections"),
+			labels, opts.ConstLabels,
+		),
+		HTTPRequestsTotalDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "http_requests_total"),
+			opts.help("http_requests_total", "Total number of HTTP requests handled"),
+			labels, opts.ConstLabels,
+		),
+		ResponseBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "status_response_bytes"),
+			opts.help("status_response_bytes", "Size of the response body of the NGINX status endpoint in the last scrape"),
+			labels, opts.ConstLabels,
+		),
+		TargetInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "exporter_target_info"),
+			opts.help("exporter_target_info", "A metric with a constant '1' value labeled by the NGINX status endpoint scraped, without credentials"),
+			append(labels, "endpoint"), opts.ConstLabels,
+		),
+		ServedByDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "exporter_served_by_info"),
+			opts.help("exporter_served_by_info", "A metric with a constant '1' value labeled by the endpoint, without credentials, and role, primary or secondary, that served the last successful scrape"),
+			append(labels, "endpoint", "role"), opts.ConstLabels,
+		),
+		AcceptedChangeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_accepted_last_change_seconds"),
+			opts.help("connections_accepted_last_change_seconds", "Unix time at which the accepted client connections were last seen to change, or were first scraped"),
+			labels, opts.ConstLabels,
+		),
+		WorkerProcessesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "worker_processes"),
+			opts.help("worker_processes", "Configured number of NGINX worker processes"),
+			labels, opts.ConstLabels,
+		),
+		ActivePerWorkerDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "connections_active_per_worker"),
+			opts.help("connections_active_per_worker", "Active client connections divided by the configured number of worker processes"),
+			labels, opts.ConstLabels,
+		),
+		InfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "info"),
+			opts.help("info", "A metric with a constant '1' value labeled by the NGINX version reported in the Server header of the status endpoint"),
+			append(labels, "version"), opts.ConstLabels,
+		),
+		ZoneRequestsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "server_zone_requests_total"),
+			opts.help("server_zone_requests_total", "Total number of requests to the server zone reported by nginx-module-vts"),
+			append(labels, "zone"), opts.ConstLabels,
+		),
+		ZoneResponsesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "server_zone_responses_total"),
+			opts.help("server_zone_responses_total", "Total number of responses of the server zone reported by nginx-module-vts by status class"),
+			append(labels, "zone", "code"), opts.ConstLabels,
+		),
+		ZoneReceivedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "server_zone_received_bytes_total"),
+			opts.help("server_zone_received_bytes_total", "Total number of bytes received from clients by the server zone reported by nginx-module-vts"),
+			append(labels, "zone"), opts.ConstLabels,
+		),
+		ZoneSentDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "server_zone_sent_bytes_total"),
+			opts.help("server_zone_sent_bytes_total", "Total number of bytes sent to clients by the server zone reported by nginx-module-vts"),
+			append(labels, "zone"), opts.ConstLabels,
+		),
+	}
+}
@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// plusConnections represents the /connections object of the NGINX Plus API.
+type plusConnections struct {
+	Accepted int64 `json:"accepted"`
+	Dropped  int64 `json:"dropped"`
+	Active   int64 `json:"active"`
+	Idle     int64 `json:"idle"`
+}
+
+// plusRequests represents the /http/requests object of the NGINX Plus API.
+type plusRequests struct {
+	Total int64 `json:"total"`
+}
+
+// GetPlusStats fetches the metrics from the NGINX Plus API at endpoint, for
+// example http://127.0.0.1/api/9. The request is bounded by ctx and the
+// timeout of the given client, whichever expires first.
+func GetPlusStats(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+) (*StubStats, error) {
+	ctx, cancel := withClientTimeout(ctx, client)
+	defer cancel()
+
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	connections, header, err := GetStatusBody(ctx, client, endpoint+"/connections")
+	if err != nil {
+		return nil, err
+	}
+
+	requests, _, err := GetStatusBody(ctx, client, endpoint+"/http/requests")
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := parsePlusStats(
+		bytes.NewReader(connections),
+		bytes.NewReader(requests),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrParse, err)
+	}
+
+	stats.ResponseBytes = int64(len(connections) + len(requests))
+	stats.Version = serverVersion(header.Get("Server"))
+
+	return stats, nil
+}
+
+// parsePlusStats parses the /connections and /http/requests objects of the
+// NGINX Plus API. The Plus API does not report the Reading and Writing
+// connection states, so these are listed as missing, and idle connections
+// are reported as Waiting.
+func parsePlusStats(connections, requests io.Reader) (*StubStats, error) {
+	var c plusConnections
+	if err := json.NewDecoder(connections).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode connections: %w", err)
+	}
+
+	var r plusRequests
+	if err := json.NewDecoder(requests).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode requests: %w", err)
+	}
+
+	return &StubStats{
+		Connections: StubConnections{
+			Active:   c.Active,
+			Accepted: c.Accepted,
+			Handled:  c.Accepted - c.Dropped,
+			Waiting:  c.Idle,
+		},
+		Requests: r.Total,
+		Missing:  []string{"Reading", "Writing"},
+	}, nil
+}
@@ -0,0 +1,81 @@
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetPlusStats(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/9/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.25.3")
+		io.WriteString(w, `{"accepted":4968119,"dropped":2,"active":5,"idle":117}`)
+	})
+	mux.HandleFunc("/api/9/http/requests", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"total":10624511,"current":4}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	stats, err := GetPlusStats(context.Background(), &http.Client{}, srv.URL+"/api/9/")
+	if err != nil {
+		t.Fatalf("GetPlusStats() error = %v", err)
+	}
+
+	want := &StubStats{
+		Connections: StubConnections{
+			Active:   5,
+			Accepted: 4968119,
+			Handled:  4968117,
+			Waiting:  117,
+		},
+		Requests:      10624511,
+		ResponseBytes: stats.ResponseBytes,
+		Missing:       []string{"Reading", "Writing"},
+		Version:       "1.25.3",
+	}
+
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("GetPlusStats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestCollectPlusOmitsReadingAndWriting(t *testing.T) {
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{"http://127.0.0.1/api/9"},
+		Fetch: func(context.Context, *http.Client, string) (*StubStats, error) {
+			return parsePlusStats(
+				strings.NewReader(`{"accepted":3,"dropped":0,"active":1,"idle":2}`),
+				strings.NewReader(`{"total":7}`),
+			)
+		},
+	})
+
+	values := gather(t, c)
+
+	for _, key := range []string{
+		`nginx_connections_reading{instance="127.0.0.1"}`,
+		`nginx_connections_writing{instance="127.0.0.1"}`,
+	} {
+		if v, ok := values[key]; ok {
+			t.Errorf("%v = %v, want it not to be exported", key, v)
+		}
+	}
+
+	for key, want := range map[string]float64{
+		`nginx_connections_active{instance="127.0.0.1"}`:  1,
+		`nginx_connections_waiting{instance="127.0.0.1"}`: 2,
+		`nginx_http_requests_total{instance="127.0.0.1"}`: 7,
+	} {
+		if got, ok := values[key]; !ok || got != want {
+			t.Errorf("%v = %v, %v, want %v", key, got, ok, want)
+		}
+	}
+}
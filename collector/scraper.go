@@ -0,0 +1,47 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// defaultClient returns the client of scrapers without one, which is shared
+// so that their connections are kept alive across scrapes.
+var defaultClient = sync.OnceValue(func() *http.Client {
+	return NewHTTPClient(HTTPClientOpts{
+		Timeout:         DefaultScrapeTimeout,
+		IdleConnTimeout: DefaultIdleConnTimeout,
+		MaxBodyBytes:    DefaultMaxBodyBytes,
+	})
+})
+
+// Scraper fetches and parses the metrics of a single NGINX status endpoint,
+// independently of the Prometheus collector and the web server.
+type Scraper struct {
+	// Endpoint is the URL of the status endpoint.
+	Endpoint string
+
+	// Client is used to fetch the metrics, defaulting to a client created
+	// once with NewHTTPClient and the default timeouts and body limit.
+	Client *http.Client
+
+	// Fetch fetches and parses the metrics, defaulting to GetStubStats.
+	Fetch FetchStatsFunc
+}
+
+// Scrape fetches and parses the metrics of the endpoint. The request is
+// bounded by ctx and the timeout of the client, whichever expires first.
+func (s *Scraper) Scrape(ctx context.Context) (*StubStats, error) {
+	client := s.Client
+	if client == nil {
+		client = defaultClient()
+	}
+
+	fetch := s.Fetch
+	if fetch == nil {
+		fetch = GetStubStats
+	}
+
+	return fetch(ctx, client, s.Endpoint)
+}
@@ -0,0 +1,632 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const templateMetrics string = `Active connections: %d
+server accepts handled requests
+%d %d %d
+Reading: %d Writing: %d Waiting: %d
+`
+
+// maxSnippetLength is the number of bytes of a response body included in
+// error messages.
+const maxSnippetLength = 128
+
+// Errors returned by GetStubStats, identifying the stage at which fetching the
+// stub_status metrics failed.
+var (
+	ErrRequest    = errors.New("failed to create the request")
+	ErrConnect    = errors.New("failed to connect to NGINX")
+	ErrHTTPStatus = errors.New("unexpected response status")
+	ErrRead       = errors.New("failed to read the response body")
+	ErrParse      = errors.New("failed to parse response body")
+
+	// ErrCredentials is wrapped by the errors of transports failing to read
+	// the credentials of a request, such as from a password file, which is
+	// then not sent.
+	ErrCredentials = errors.New("failed to read the credentials")
+
+	// ErrRateLimited is matched by a *StatusError for a 429 Too Many
+	// Requests response, in addition to ErrHTTPStatus.
+	ErrRateLimited = errors.New("rate limited by NGINX")
+)
+
+// StatusError is returned by GetStubStats when a status endpoint responds
+// with a status code other than 200 OK. It matches ErrHTTPStatus.
+type StatusError struct {
+	// Endpoint is the status endpoint, with any password redacted.
+	Endpoint string
+	Code     int
+
+	// Location is the redirect target of a redirect response, with any
+	// password redacted.
+	Location string
+
+	// RetryAfter is the delay requested in the Retry-After header of the
+	// response, if any.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *StatusError) Error() string {
+	if e.Location != "" {
+		return fmt.Sprintf(
+			"%v: expected %v response from %v, got %v %v redirecting to %v",
+			ErrHTTPStatus,
+			http.StatusOK,
+			e.Endpoint,
+			e.Code,
+			http.StatusText(e.Code),
+			e.Location,
+		)
+	}
+
+	return fmt.Sprintf(
+		"%v: expected %v response from %v, got %v %v",
+		ErrHTTPStatus,
+		http.StatusOK,
+		e.Endpoint,
+		e.Code,
+		http.StatusText(e.Code),
+	)
+}
+
+// Is reports whether target is ErrHTTPStatus, or ErrRateLimited for a 429 Too
+// Many Requests response.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrHTTPStatus ||
+		target == ErrRateLimited && e.Code == http.StatusTooManyRequests
+}
+
+// Hint returns advice on resolving common causes of the status code, or an
+// empty string if there is none.
+func (e *StatusError) Hint() string {
+	switch e.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "check the credentials for the status endpoint"
+	case http.StatusNotFound:
+		return "check the path of the status endpoint"
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return "use the redirect target as the status endpoint, or set NGINX_STATUS_FOLLOW_REDIRECTS=true"
+	case http.StatusTooManyRequests:
+		return "scrape less often, for example with MIN_SCRAPE_INTERVAL, or raise the rate limit of the status endpoint"
+	default:
+		return ""
+	}
+}
+
+// StubStats represents NGINX stub_status metrics.
+type StubStats struct {
+	Connections StubConnections `json:"connections"`
+	Requests    int64           `json:"requests"`
+
+	// ResponseBytes is the size of the response bodies the metrics were
+	// parsed from.
+	ResponseBytes int64 `json:"-"`
+
+	// Missing lists the fields, named as in stubStatsFields, that the
+	// response did not contain. Their values are zero.
+	Missing []string `json:"-"`
+
+	// Version is the NGINX version reported in the Server header of the
+	// response, if any.
+	Version string `json:"-"`
+
+	// ServerZones are the server zones reported by the nginx-module-vts
+	// module, keyed by name.
+	ServerZones map[string]ServerZone `json:"server_zones,omitempty"`
+}
+
+// ServerZone represents the metrics of a server zone of the nginx-module-vts
+// module.
+type ServerZone struct {
+	Requests      int64 `json:"requests"`
+	ReceivedBytes int64 `json:"received_bytes"`
+	SentBytes     int64 `json:"sent_bytes"`
+
+	// Responses are the numbers of responses by status class, such as 2xx.
+	Responses map[string]int64 `json:"responses"`
+}
+
+// has reports whether the response contained field, named as in
+// stubStatsFields.
+func (s *StubStats) has(field string) bool {
+	return !slices.Contains(s.Missing, field)
+}
+
+// StubConnections represents connections related metrics.
+type StubConnections struct {
+	Active   int64 `json:"active"`
+	Accepted int64 `json:"accepted"`
+	Handled  int64 `json:"handled"`
+	Reading  int64 `json:"reading"`
+	Writing  int64 `json:"writing"`
+	Waiting  int64 `json:"waiting"`
+}
+
+// RetryAfter returns the delay requested by the Retry-After header in h, given
+// either in seconds or as an HTTP date.
+func RetryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+
+	return 0, false
+}
+
+// GetStubStats fetches the stub_status metrics. The request is bounded by ctx
+// and the timeout of the given client, whichever expires first.
+func GetStubStats(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+) (*StubStats, error) {
+	return getStubStats(ctx, client, endpoint, false)
+}
+
+// GetStubStatsStrict is like GetStubStats, but fails if the stub_status output
+// lacks any of the expected fields or has content beyond them.
+func GetStubStatsStrict(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+) (*StubStats, error) {
+	return getStubStats(ctx, client, endpoint, true)
+}
+
+func getStubStats(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+	strict bool,
+) (*StubStats, error) {
+	ctx, cancel := withClientTimeout(ctx, client)
+	defer cancel()
+
+	body, header, err := GetStatusBody(ctx, client, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("Active connections:")) {
+		return nil, fmt.Errorf(
+			"%w %q: unexpected body, does not look like stub_status output",
+			ErrParse,
+			snippet(body),
+		)
+	}
+
+	r := bytes.NewReader(body)
+
+	stats, err := parseStubStats(r, strict)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w %q: %w",
+			ErrParse,
+			snippet(body),
+			err,
+		)
+	}
+
+	stats.ResponseBytes = int64(len(body))
+	stats.Version = serverVersion(header.Get("Server"))
+
+	return stats, nil
+}
+
+// withClientTimeout returns a copy of ctx that is canceled once the timeout
+// of client expires, if it has one. A zero timeout means no timeout, as for
+// http.Client itself.
+func withClientTimeout(
+	ctx context.Context,
+	client *http.Client,
+) (context.Context, context.CancelFunc) {
+	if client.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, client.Timeout)
+}
+
+// serverVersion returns the NGINX version in the value of a Server header,
+// such as 1.25.3 for "nginx/1.25.3", or "" if it has none, for example because
+// server_tokens is off.
+func serverVersion(server string) string {
+	product, _, _ := strings.Cut(server, " ")
+
+	name, version, ok := strings.Cut(product, "/")
+	if !ok || !strings.EqualFold(name, "nginx") {
+		return ""
+	}
+
+	return version
+}
+
+// GetStatusBody fetches the body of a status endpoint along with the headers
+// of the response.
+func GetStatusBody(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+) ([]byte, http.Header, error) {
+	start := time.Now()
+	redacted := RedactURL(endpoint)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		endpoint,
+		http.NoBody,
+	)
+	if err != nil {
+		// The error of parsing the endpoint includes it along with any
+		// password, so only the cause is kept.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return nil, nil, fmt.Errorf("%w: invalid endpoint URL: %w", ErrRequest, urlErr.Err)
+		}
+
+		return nil, nil, fmt.Errorf("%w: %w", ErrRequest, err)
+	}
+
+	// Setting Accept-Encoding disables the transparent decompression of the
+	// transport, so compressed responses are decompressed below.
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var (
+			dnsErr *net.DNSError
+			netErr net.Error
+		)
+
+		switch {
+		case errors.Is(err, ErrCredentials):
+			return nil, nil, fmt.Errorf("error getting %v: %w", redacted, err)
+		case errors.As(err, &dnsErr):
+			return nil, nil, fmt.Errorf(
+				"%w: DNS lookup failed for host %v: %w",
+				ErrConnect,
+				dnsErr.Name,
+				err,
+			)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return nil, nil, fmt.Errorf(
+				"%w: timed out after %v getting %v: %w",
+				ErrConnect,
+				time.Since(start).Round(time.Millisecond),
+				redacted,
+				err,
+			)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return nil, nil, fmt.Errorf(
+				"%w: connection refused by %v: %w",
+				ErrConnect,
+				redacted,
+				err,
+			)
+		default:
+			return nil, nil, fmt.Errorf("%w: error getting %v: %w", ErrConnect, redacted, err)
+		}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &StatusError{Endpoint: redacted, Code: resp.StatusCode}
+		if location, err := resp.Location(); err == nil {
+			statusErr.Location = location.Redacted()
+		}
+		if d, ok := RetryAfter(resp.Header); ok {
+			statusErr.RetryAfter = d
+		}
+
+		return nil, nil, statusErr
+	}
+
+	var r io.Reader = resp.Body
+
+	// Responses are also decompressed when a proxy compresses them without
+	// being asked to.
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrRead, err)
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrRead, err)
+	}
+
+	return body, resp.Header, nil
+}
+
+// snippet returns the beginning of body for inclusion in error messages.
+func snippet(body []byte) string {
+	if len(body) <= maxSnippetLength {
+		return string(body)
+	}
+
+	return string(body[:maxSnippetLength]) + "..."
+}
+
+// ParseError is returned by parseStubStats when stub_status output can't be
+// parsed, recording how far parsing got.
+type ParseError struct {
+	// Parsed is the number of fields parsed successfully out of Total.
+	Parsed int
+	Total  int
+
+	// Field is the name of the StubStats field at which parsing stopped.
+	Field string
+
+	Err error
+}
+
+// Error implements error.
+func (e *ParseError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("parsed %d of %d fields: %v", e.Parsed, e.Total, e.Err)
+	}
+
+	return fmt.Sprintf(
+		"parsed %d of %d fields, failed at %v: %v",
+		e.Parsed,
+		e.Total,
+		e.Field,
+		e.Err,
+	)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// stubStatsFields names the fields scanned from each line of templateMetrics.
+var stubStatsFields = [][]string{
+	{"Active"},
+	{},
+	{"Accepted", "Handled", "Requests"},
+	{"Reading", "Writing", "Waiting"},
+}
+
+// scanLabeled scans the integers following each of labels in line, such as
+// "Reading: 0 Writing: 1", into values, regardless of their order. It returns
+// the index of the label at which it failed, the labels not found in line,
+// whose values are left unchanged, and the labels of line that are not in
+// labels.
+func scanLabeled(
+	line string,
+	labels []string,
+	values []any,
+) (n int, missing, unknown []string, err error) {
+	found := make(map[string]string)
+
+	fields := strings.Fields(strings.ReplaceAll(line, ":", ": "))
+	for i := 0; i < len(fields); i += 2 {
+		label, ok := strings.CutSuffix(fields[i], ":")
+		if !ok || i+1 >= len(fields) {
+			return 0, nil, nil, fmt.Errorf("expected label and value, got %q", fields[i])
+		}
+
+		if !slices.Contains(labels, label) {
+			unknown = append(unknown, label)
+		}
+
+		found[label] = fields[i+1]
+	}
+
+	for n, label := range labels {
+		v, ok := found[label]
+		if !ok {
+			missing = append(missing, label)
+			continue
+		}
+
+		if *values[n].(*int64), err = strconv.ParseInt(v, 10, 64); err != nil {
+			return n, nil, nil, fmt.Errorf("%v: %w", label, err)
+		}
+	}
+
+	return len(labels), missing, unknown, nil
+}
+
+// firstNegative returns the index of the first of values that is negative, or
+// -1 if there is none. NGINX reports counts and gauges as unsigned integers,
+// so a negative value is not stub_status output, and exporting it would break
+// rate() and alerts on the connection gauges.
+func firstNegative(values []any) int {
+	for i, v := range values {
+		if *v.(*int64) < 0 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// stubStatsLabeledLine is the line of templateMetrics whose fields are found
+// by their labels, which are the names in stubStatsFields, rather than by
+// position, as some NGINX builds reorder or add to them.
+const stubStatsLabeledLine = 3
+
+// parseStubStats parses stub_status output. Lines are matched one by one
+// against templateMetrics, ignoring blank lines, surrounding whitespace, runs
+// of spaces and CRLF line endings. Negative values are rejected. The fields of
+// stubStatsLabeledLine may be in any order, and unknown labels are ignored.
+// Fields missing from output that ends early or lacks some labels are listed
+// in StubStats.Missing. In strict mode, missing fields and content following
+// the expected fields are errors rather than being ignored. Parse failures are
+// reported as a *ParseError.
+func parseStubStats(r io.Reader, strict bool) (*StubStats, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read template metrics: %w", err)
+	}
+
+	var s StubStats
+
+	templates := strings.Split(strings.TrimSuffix(templateMetrics, "\n"), "\n")
+	values := [][]any{
+		{&s.Connections.Active},
+		{},
+		{&s.Connections.Accepted, &s.Connections.Handled, &s.Requests},
+		{&s.Connections.Reading, &s.Connections.Writing, &s.Connections.Waiting},
+	}
+
+	total := 0
+	for _, fields := range stubStatsFields {
+		total += len(fields)
+	}
+
+	parsed := 0
+
+	// failed returns a *ParseError for a failure after n fields of line i were
+	// parsed.
+	failed := func(i, n int, err error) *ParseError {
+		for ; i < len(stubStatsFields); i, n = i+1, 0 {
+			if n < len(stubStatsFields[i]) {
+				break
+			}
+		}
+
+		e := &ParseError{Parsed: parsed + n, Total: total, Err: err}
+		if i < len(stubStatsFields) {
+			e.Field = stubStatsFields[i][n]
+		}
+
+		return e
+	}
+
+	for i, template := range templates {
+		// Reduced output ending after some of the lines, as served by some
+		// reverse proxies, leaves the fields of the remaining lines missing.
+		if i >= len(lines) && !strict && parsed > 0 {
+			for _, fields := range stubStatsFields[i:] {
+				s.Missing = append(s.Missing, fields...)
+			}
+			break
+		}
+
+		if i >= len(lines) {
+			return nil, failed(i, 0, fmt.Errorf(
+				"expected %d lines, got %d",
+				len(templates),
+				len(lines),
+			))
+		}
+
+		if len(values[i]) == 0 {
+			if lines[i] != template {
+				return nil, failed(i, 0, fmt.Errorf(
+					"expected line %d to be %q, got %q",
+					i+1,
+					template,
+					lines[i],
+				))
+			}
+			continue
+		}
+
+		if i == stubStatsLabeledLine {
+			n, missing, unknown, err := scanLabeled(lines[i], stubStatsFields[i], values[i])
+			if err != nil {
+				return nil, failed(i, n, fmt.Errorf("line %d: %w", i+1, err))
+			}
+
+			if strict && len(missing) > 0 {
+				k := slices.Index(stubStatsFields[i], missing[0])
+				return nil, failed(i, k, fmt.Errorf("line %d: missing %v", i+1, missing[0]))
+			}
+
+			if k := firstNegative(values[i]); k >= 0 {
+				return nil, failed(i, k, fmt.Errorf("line %d: negative value", i+1))
+			}
+
+			parsed += n - len(missing)
+			s.Missing = append(s.Missing, missing...)
+
+			if strict && len(unknown) > 0 {
+				return nil, &ParseError{Parsed: parsed, Total: total, Err: fmt.Errorf(
+					"unexpected labels %q on line %d: %q",
+					unknown,
+					i+1,
+					lines[i],
+				)}
+			}
+			continue
+		}
+
+		n, err := fmt.Sscanf(lines[i], template, values[i]...)
+		if err != nil {
+			return nil, failed(i, n, fmt.Errorf("line %d: %w", i+1, err))
+		}
+
+		if k := firstNegative(values[i]); k >= 0 {
+			return nil, failed(i, k, fmt.Errorf("line %d: negative value", i+1))
+		}
+
+		parsed += n
+
+		if strict {
+			var extra string
+			if m, _ := fmt.Sscanf(lines[i], template+" %s", append(values[i], &extra)...); m > n {
+				return nil, &ParseError{Parsed: parsed, Total: total, Err: fmt.Errorf(
+					"unexpected trailing content on line %d: %q",
+					i+1,
+					lines[i],
+				)}
+			}
+		}
+	}
+
+	if strict && len(lines) > len(templates) {
+		return nil, &ParseError{Parsed: parsed, Total: total, Err: fmt.Errorf(
+			"unexpected trailing line %d: %q",
+			len(templates)+1,
+			lines[len(templates)],
+		)}
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// vtsStatus represents the JSON status of the nginx-module-vts module.
+type vtsStatus struct {
+	NginxVersion string                   `json:"nginxVersion"`
+	Connections  *vtsConnections          `json:"connections"`
+	ServerZones  map[string]vtsServerZone `json:"serverZones"`
+}
+
+// vtsConnections represents the connections object of the VTS status.
+type vtsConnections struct {
+	Active   int64 `json:"active"`
+	Reading  int64 `json:"reading"`
+	Writing  int64 `json:"writing"`
+	Waiting  int64 `json:"waiting"`
+	Accepted int64 `json:"accepted"`
+	Handled  int64 `json:"handled"`
+	Requests int64 `json:"requests"`
+}
+
+// vtsServerZone represents a server zone of the VTS status.
+type vtsServerZone struct {
+	RequestCounter int64            `json:"requestCounter"`
+	InBytes        int64            `json:"inBytes"`
+	OutBytes       int64            `json:"outBytes"`
+	Responses      map[string]int64 `json:"responses"`
+}
+
+// vtsResponseClasses lists the response status classes of server zones that
+// are exported, as VTS also counts cache statuses among the responses.
+var vtsResponseClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// GetVTSStats fetches the metrics from the JSON status of the
+// nginx-module-vts module at endpoint, for example
+// http://127.0.0.1/status/format/json. The request is bounded by ctx and the
+// timeout of the given client, whichever expires first.
+func GetVTSStats(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+) (*StubStats, error) {
+	ctx, cancel := withClientTimeout(ctx, client)
+	defer cancel()
+
+	body, header, err := GetStatusBody(ctx, client, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := parseVTSStats(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrParse, err)
+	}
+
+	stats.ResponseBytes = int64(len(body))
+	if stats.Version == "" {
+		stats.Version = serverVersion(header.Get("Server"))
+	}
+
+	return stats, nil
+}
+
+// parseVTSStats parses the JSON status of the nginx-module-vts module. The
+// connections are those of stub_status, and each server zone is reported
+// separately, including the "*" zone that VTS sums all others into.
+func parseVTSStats(r io.Reader) (*StubStats, error) {
+	var s vtsStatus
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to decode status: %w", err)
+	}
+
+	if s.Connections == nil {
+		return nil, errors.New("missing connections")
+	}
+
+	stats := &StubStats{
+		Connections: StubConnections{
+			Active:   s.Connections.Active,
+			Accepted: s.Connections.Accepted,
+			Handled:  s.Connections.Handled,
+			Reading:  s.Connections.Reading,
+			Writing:  s.Connections.Writing,
+			Waiting:  s.Connections.Waiting,
+		},
+		Requests: s.Connections.Requests,
+		Version:  s.NginxVersion,
+	}
+
+	if len(s.ServerZones) > 0 {
+		stats.ServerZones = make(map[string]ServerZone, len(s.ServerZones))
+	}
+
+	for name, zone := range s.ServerZones {
+		responses := make(map[string]int64, len(vtsResponseClasses))
+		for _, class := range vtsResponseClasses {
+			responses[class] = zone.Responses[class]
+		}
+
+		stats.ServerZones[name] = ServerZone{
+			Requests:      zone.RequestCounter,
+			ReceivedBytes: zone.InBytes,
+			SentBytes:     zone.OutBytes,
+			Responses:     responses,
+		}
+	}
+
+	return stats, nil
+}
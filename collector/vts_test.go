@@ -0,0 +1,141 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vtsStatusJSON is a trimmed JSON status of nginx-module-vts.
+const vtsStatusJSON = `{
+  "hostName": "web-1",
+  "nginxVersion": "1.25.3",
+  "loadMsec": 1700000000000,
+  "nowMsec": 1700000060000,
+  "connections": {
+    "active": 3,
+    "reading": 0,
+    "writing": 1,
+    "waiting": 2,
+    "accepted": 120,
+    "handled": 120,
+    "requests": 480
+  },
+  "sharedZones": {"name": "ngx_http_vhost_traffic_status", "maxSize": 1048575, "usedSize": 3510, "usedNode": 2},
+  "serverZones": {
+    "example.com": {
+      "requestCounter": 450,
+      "inBytes": 90000,
+      "outBytes": 1800000,
+      "responses": {"1xx": 0, "2xx": 400, "3xx": 20, "4xx": 25, "5xx": 5, "miss": 12, "hit": 30}
+    },
+    "*": {
+      "requestCounter": 480,
+      "inBytes": 96000,
+      "outBytes": 1900000,
+      "responses": {"1xx": 0, "2xx": 425, "3xx": 20, "4xx": 30, "5xx": 5, "miss": 12, "hit": 30}
+    }
+  }
+}`
+
+func TestGetVTSStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, vtsStatusJSON)
+	}))
+	defer srv.Close()
+
+	stats, err := GetVTSStats(context.Background(), &http.Client{}, srv.URL+"/status/format/json")
+	if err != nil {
+		t.Fatalf("GetVTSStats() error = %v", err)
+	}
+
+	want := &StubStats{
+		Connections: StubConnections{
+			Active:   3,
+			Accepted: 120,
+			Handled:  120,
+			Writing:  1,
+			Waiting:  2,
+		},
+		Requests:      480,
+		ResponseBytes: int64(len(vtsStatusJSON)),
+		Version:       "1.25.3",
+		ServerZones: map[string]ServerZone{
+			"example.com": {
+				Requests:      450,
+				ReceivedBytes: 90000,
+				SentBytes:     1800000,
+				Responses:     map[string]int64{"1xx": 0, "2xx": 400, "3xx": 20, "4xx": 25, "5xx": 5},
+			},
+			"*": {
+				Requests:      480,
+				ReceivedBytes: 96000,
+				SentBytes:     1900000,
+				Responses:     map[string]int64{"1xx": 0, "2xx": 425, "3xx": 20, "4xx": 30, "5xx": 5},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("GetVTSStats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestGetVTSStatsMalformed(t *testing.T) {
+	for name, body := range map[string]string{
+		"not json":            "Active connections: 1\n",
+		"missing connections": `{"nginxVersion":"1.25.3","serverZones":{}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, body)
+			}))
+			defer srv.Close()
+
+			_, err := GetVTSStats(context.Background(), &http.Client{}, srv.URL)
+			if !errors.Is(err, ErrParse) {
+				t.Errorf("GetVTSStats() error = %v, want %v", err, ErrParse)
+			}
+		})
+	}
+}
+
+func TestCollectVTSServerZones(t *testing.T) {
+	c := NewCollectMetrics(CollectorOpts{
+		Metrics:   MetricsOpts{Namespace: "nginx"},
+		Endpoints: []string{"http://127.0.0.1/status/format/json"},
+		Fetch: func(context.Context, *http.Client, string) (*StubStats, error) {
+			return parseVTSStats(strings.NewReader(vtsStatusJSON))
+		},
+	})
+
+	values := gather(t, c)
+
+	for key, want := range map[string]float64{
+		`nginx_connections_active{instance="127.0.0.1"}`:                                        3,
+		`nginx_http_requests_total{instance="127.0.0.1"}`:                                       480,
+		`nginx_server_zone_requests_total{instance="127.0.0.1",zone="example.com"}`:             450,
+		`nginx_server_zone_received_bytes_total{instance="127.0.0.1",zone="example.com"}`:       90000,
+		`nginx_server_zone_sent_bytes_total{instance="127.0.0.1",zone="example.com"}`:           1.8e+06,
+		`nginx_server_zone_responses_total{code="2xx",instance="127.0.0.1",zone="example.com"}`: 400,
+		`nginx_server_zone_responses_total{code="5xx",instance="127.0.0.1",zone="example.com"}`: 5,
+		`nginx_server_zone_requests_total{instance="127.0.0.1",zone="*"}`:                       480,
+		`nginx_server_zone_responses_total{code="4xx",instance="127.0.0.1",zone="*"}`:           30,
+	} {
+		if got, ok := values[key]; !ok || got != want {
+			t.Errorf("%v = %v, %v, want %v", key, got, ok, want)
+		}
+	}
+
+	for key := range values {
+		if strings.Contains(key, `code="miss"`) || strings.Contains(key, `code="hit"`) {
+			t.Errorf("%v exported, want cache statuses to be omitted", key)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/betterstack-community/custom-nginx-exporter/collector"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the configuration read from the file given by -config.file.
+// Environment variables override its values, and command-line flags override
+// both.
+type fileConfig struct {
+	Endpoints     []string      `yaml:"endpoints"`
+	Timeout       time.Duration `yaml:"timeout"`
+	ListenAddress string        `yaml:"listen_address"`
+	Namespace     string        `yaml:"namespace"`
+
+	// Help overrides the help strings of metrics, keyed by metric name
+	// without namespace and subsystem.
+	Help map[string]string `yaml:"help"`
+
+	TLS struct {
+		CAFile             string `yaml:"ca_file"`
+		CertFile           string `yaml:"cert_file"`
+		KeyFile            string `yaml:"key_file"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	} `yaml:"tls"`
+
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+}
+
+// loadFileConfig reads the configuration file at path. An empty path yields
+// an empty configuration.
+func loadFileConfig(path string) (*fileConfig, error) {
+	var cfg fileConfig
+
+	if path == "" {
+		return &cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open configuration file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse configuration file %v: %w", path, err)
+	}
+
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf(
+			"invalid configuration file %v: timeout must not be negative",
+			path,
+		)
+	}
+
+	for name := range cfg.Help {
+		if !slices.Contains(collector.MetricNames(), name) {
+			return nil, fmt.Errorf(
+				"invalid configuration file %v: help for unknown metric %q",
+				path,
+				name,
+			)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// applyToFlags sets the flags of fs that have a counterpart in the
+// configuration file, unless they were given on the command line or their
+// environment variable is set.
+func (c *fileConfig) applyToFlags(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, f := range []struct {
+		name  string
+		env   string
+		value string
+	}{
+		{"web.listen-address", "WEB_LISTEN_ADDRESS", c.ListenAddress},
+		{"metrics.namespace", "METRICS_NAMESPACE", c.Namespace},
+	} {
+		if set[f.name] || os.Getenv(f.env) != "" || f.value == "" {
+			continue
+		}
+
+		if err := fs.Set(f.name, f.value); err != nil {
+			return fmt.Errorf("invalid value %q for -%v: %w", f.value, f.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationRE matches durations, such as 1.5s or 1m30s, embedded in errors.
+var durationRE = regexp.MustCompile(`\b(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+\b`)
+
+// dedupHandler passes identical warnings and errors on to the next handler at
+// most once per interval. Once the interval of a logged record expires, the
+// last record suppressed in between, if any, is passed on with the number of
+// suppressed records as the suppressed attribute. Records whose err
+// attributes only differ in the durations they embed, such as the time a
+// scrape took to time out, are considered identical.
+type dedupHandler struct {
+	next     slog.Handler
+	interval time.Duration
+	prefix   string
+	state    *dedupState
+}
+
+// dedupState holds the records last logged by a dedupHandler, shared with the
+// handlers derived from it by WithAttrs and WithGroup.
+type dedupState struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// dedupEntry records when a record was last logged and how many identical
+// records were suppressed since. The last suppressed record is kept with the
+// handler it is to be passed on to, and flush passes it on once the interval
+// expires.
+type dedupEntry struct {
+	logged     time.Time
+	suppressed int
+	last       slog.Record
+	next       slog.Handler
+	flush      *time.Timer
+}
+
+// newDedupHandler creates a dedupHandler passing records on to next.
+func newDedupHandler(next slog.Handler, interval time.Duration) *dedupHandler {
+	return &dedupHandler{
+		next:     next,
+		interval: interval,
+		state:    &dedupState{entries: make(map[string]*dedupEntry)},
+	}
+}
+
+// Enabled implements slog.Handler.
+func (h *dedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler. Records below the warning level are always
+// passed on.
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+
+	key := h.key(r)
+
+	h.state.mu.Lock()
+	e, ok := h.state.entries[key]
+	if ok && r.Time.Sub(e.logged) < h.interval {
+		e.suppressed++
+		e.last = r.Clone()
+		e.next = h.next
+		if e.flush == nil {
+			e.flush = time.AfterFunc(time.Until(e.logged.Add(h.interval)), func() {
+				h.flush(key, e)
+			})
+		}
+		h.state.mu.Unlock()
+		return nil
+	}
+
+	suppressed := 0
+	if ok {
+		suppressed = e.suppressed
+		if e.flush != nil {
+			e.flush.Stop()
+		}
+	}
+
+	for k, e := range h.state.entries {
+		if e.suppressed == 0 && r.Time.Sub(e.logged) >= h.interval {
+			delete(h.state.entries, k)
+		}
+	}
+
+	h.state.entries[key] = &dedupEntry{logged: r.Time}
+	h.state.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+
+	return h.next.Handle(ctx, r)
+}
+
+// flush passes on the last record suppressed by e, the entry of key, with the
+// number of records suppressed, unless a record logged since replaced e. The
+// interval of that record then starts, so that the records of key are still
+// passed on at most once per interval.
+func (h *dedupHandler) flush(key string, e *dedupEntry) {
+	h.state.mu.Lock()
+	if h.state.entries[key] != e || e.suppressed == 0 {
+		h.state.mu.Unlock()
+		return
+	}
+
+	r, next, suppressed := e.last, e.next, e.suppressed
+	h.state.entries[key] = &dedupEntry{logged: time.Now()}
+	h.state.mu.Unlock()
+
+	r.AddAttrs(slog.Int("suppressed", suppressed))
+	next.Handle(context.Background(), r)
+}
+
+// WithAttrs implements slog.Handler. The attributes are part of the key of
+// the records of the returned handler.
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	for _, a := range attrs {
+		fmt.Fprintf(&b, "%v;", a)
+	}
+
+	return &dedupHandler{
+		next:     h.next.WithAttrs(attrs),
+		interval: h.interval,
+		prefix:   b.String(),
+		state:    h.state,
+	}
+}
+
+// WithGroup implements slog.Handler.
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{
+		next:     h.next.WithGroup(name),
+		interval: h.interval,
+		prefix:   h.prefix + name + ".",
+		state:    h.state,
+	}
+}
+
+// key identifies the records considered identical to r.
+func (h *dedupHandler) key(r slog.Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v%v;%v;", h.prefix, r.Level, r.Message)
+
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "err" {
+			a.Value = slog.StringValue(durationRE.ReplaceAllString(a.Value.String(), "0s"))
+		}
+		fmt.Fprintf(&b, "%v;", a)
+		return true
+	})
+
+	return b.String()
+}
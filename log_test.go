@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHandler is an slog.Handler keeping the records it handles.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+// Enabled implements slog.Handler.
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle implements slog.Handler.
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, r.Clone())
+
+	return nil
+}
+
+// WithAttrs implements slog.Handler.
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+// WithGroup implements slog.Handler.
+func (h *recordingHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// attrs returns the attributes of the records handled so far.
+func (h *recordingHandler) attrs() []map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var attrs []map[string]string
+	for _, r := range h.records {
+		m := make(map[string]string)
+		r.Attrs(func(a slog.Attr) bool {
+			m[a.Key] = a.Value.String()
+			return true
+		})
+		attrs = append(attrs, m)
+	}
+
+	return attrs
+}
+
+func TestDedupHandlerErrors(t *testing.T) {
+	rec := &recordingHandler{}
+	logger := slog.New(newDedupHandler(rec, time.Hour))
+
+	for _, err := range []string{
+		"connection refused",
+		"timed out after 1.2s",
+		"timed out after 3.4s",
+		"connection refused",
+	} {
+		logger.Warn("scrape failed", "err", err)
+	}
+
+	attrs := rec.attrs()
+	if len(attrs) != 2 || attrs[0]["err"] != "connection refused" || attrs[1]["err"] != "timed out after 1.2s" {
+		t.Errorf("records = %v, want each error once, ignoring durations", attrs)
+	}
+}
+
+func TestDedupHandlerFlush(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	rec := &recordingHandler{}
+	logger := slog.New(newDedupHandler(rec, interval))
+
+	for range 3 {
+		logger.Warn("scrape failed", "err", "connection refused")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.attrs()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(interval)
+	}
+
+	attrs := rec.attrs()
+	if len(attrs) != 2 || attrs[1]["suppressed"] != "2" {
+		t.Fatalf("records = %v, want the suppressed records reported once the interval expires", attrs)
+	}
+
+	time.Sleep(3 * interval)
+	if attrs := rec.attrs(); len(attrs) != 2 {
+		t.Errorf("records = %v, want nothing more reported", attrs)
+	}
+}
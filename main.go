@@ -1,218 +1,1877 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/betterstack-community/custom-nginx-exporter/collector"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
-const templateMetrics string = `Active connections: %d
-server accepts handled requests
-%d %d %d
-Reading: %d Writing: %d Waiting: %d
+const templateLandingPage string = `<html>
+<head><title>NGINX Exporter</title></head>
+<body>
+<h1>NGINX Exporter</h1>
+<p><a href="%s">Metrics</a></p>
+</body>
+</html>
 `
 
-// StubStats represents NGINX stub_status metrics.
-type StubStats struct {
-	Connections StubConnections
-	Requests    int64
+// Build information, set at build time using
+// -ldflags "-X main.version=... -X main.revision=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	revision  = "unknown"
+	buildDate = "unknown"
+)
+
+// startTime is when the exporter was started.
+var startTime = time.Now()
+
+// metricNamePartRE matches valid metric namespaces and subsystems.
+var metricNamePartRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelNameRE matches valid label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelNames are the names of the variable labels of the metrics and
+// of the build labels of exporter_build_info, which constant labels cannot
+// take.
+var reservedLabelNames = []string{
+	"instance",
+	"reason",
+	"stage",
+	"endpoint",
+	"zone",
+	"code",
+	"version",
+	"role",
+	"revision",
+	"goversion",
 }
 
-// StubConnections represents connections related metrics.
-type StubConnections struct {
-	Active   int64
-	Accepted int64
-	Handled  int64
-	Reading  int64
-	Writing  int64
-	Waiting  int64
+// maxRedirects is the number of redirects followed when
+// NGINX_STATUS_FOLLOW_REDIRECTS is enabled.
+const maxRedirects = 10
+
+// defaultLogDedupInterval is used when LOG_DEDUP_INTERVAL is unset.
+const defaultLogDedupInterval = time.Minute
+
+// defaultRecentErrors is used when WEB_DEBUG_ERRORS_SIZE is unset.
+const defaultRecentErrors = 100
+
+// defaultRetryBackoff is used when NGINX_SCRAPE_RETRY_BACKOFF_SECONDS is unset.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// shutdownGracePeriod is how long in-flight requests are given to complete
+// once a termination signal is received.
+const shutdownGracePeriod = 5 * time.Second
+
+// checkSameHostRedirect is an http.Client CheckRedirect function following up
+// to maxRedirects redirects, as long as they stay on the host of the original
+// request. Credentials added by the transports are not sent to other hosts.
+func checkSameHostRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if req.URL.Hostname() != via[0].URL.Hostname() {
+		return fmt.Errorf(
+			"refusing to follow redirect to another host: %v",
+			collector.RedactURL(req.URL.String()),
+		)
+	}
+
+	return nil
 }
 
-// GetStubStats fetches the stub_status metrics.
-func GetStubStats(endpoint string) (*StubStats, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// headerTransport is an http.RoundTripper that sets headers on every request.
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
 
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		endpoint,
-		http.NoBody,
-	)
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// basicAuthTransport is an http.RoundTripper that adds HTTP basic auth
+// credentials to every request. If passwordFile is set, the password is read
+// from it, so that it can be rotated without a restart, and the request fails
+// with collector.ErrCredentials if it cannot be read.
+type basicAuthTransport struct {
+	username     string
+	password     string
+	passwordFile *secretFile
+	next         http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	password := t.password
+	if t.passwordFile != nil {
+		var err error
+		if password, err = t.passwordFile.read(); err != nil {
+			return nil, fmt.Errorf("%w: %w", collector.ErrCredentials, err)
+		}
+	}
+
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, password)
+
+	return t.next.RoundTrip(req)
+}
+
+// bearerTokenTransport is an http.RoundTripper that adds a bearer token to
+// every request. If tokenFile is set, the token is read from it, so that it
+// can be rotated without a restart, and the request fails with
+// collector.ErrCredentials if it cannot be read.
+type bearerTokenTransport struct {
+	token     string
+	tokenFile *secretFile
+	next      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *bearerTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.token
+	if t.tokenFile != nil {
+		var err error
+		if token, err = t.tokenFile.read(); err != nil {
+			return nil, fmt.Errorf("%w: %w", collector.ErrCredentials, err)
+		}
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return t.next.RoundTrip(req)
+}
+
+// secretFile reads a secret, such as a password or bearer token, from a file,
+// reading it again only when the file's modification time changes so that
+// rotated secrets are picked up without reading the file on every request.
+// It is safe for concurrent use.
+type secretFile struct {
+	name string
+	path string
+
+	mu      sync.Mutex
+	secret  string
+	modTime time.Time
+}
+
+// newSecretFile creates a secretFile reading the secret named name, such as
+// "bearer token", from path, failing if it cannot be read.
+func newSecretFile(name, path string) (*secretFile, error) {
+	f := &secretFile{name: name, path: path}
+	if _, err := f.read(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// read returns the secret, ignoring surrounding whitespace. The secret is not
+// included in returned errors.
+func (f *secretFile) read() (string, error) {
+	info, err := os.Stat(f.path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create a get request: %w", err)
+		return "", fmt.Errorf("failed to read %v file: %w", f.name, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.secret != "" && info.ModTime().Equal(f.modTime) {
+		return f.secret, nil
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	b, err := os.ReadFile(f.path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get %v: %w", endpoint, err)
+		return "", fmt.Errorf("failed to read %v file: %w", f.name, err)
 	}
 
-	defer resp.Body.Close()
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("%v file %v is empty", f.name, f.path)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"expected %v response, got %v",
-			http.StatusOK,
-			resp.StatusCode,
+	f.secret = secret
+	f.modTime = info.ModTime()
+
+	return secret, nil
+}
+
+// retryTransport is an http.RoundTripper that retries requests failing with a
+// transport error or a 429 Too Many Requests response, waiting backoff before
+// the first retry and doubling the wait after each one. A Retry-After header
+// of a 429 response overrides the wait. Retries are abandoned once the
+// request's context deadline would be exceeded.
+type retryTransport struct {
+	retries int
+	backoff time.Duration
+	next    http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	wait := t.backoff
+
+	for retry := 0; ; retry++ {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests {
+			if retry > 0 {
+				slog.Info(
+					"request succeeded after retrying",
+					"endpoint", req.URL.Redacted(),
+					"retries", retry,
+				)
+			}
+			return resp, nil
+		}
+
+		if retry == t.retries {
+			return resp, err
+		}
+
+		delay := wait
+		attrs := []any{"endpoint", req.URL.Redacted()}
+
+		if resp != nil {
+			if d, ok := collector.RetryAfter(resp.Header); ok {
+				delay = d
+			}
+			attrs = append(attrs, "status_code", resp.StatusCode)
+		} else {
+			attrs = append(attrs, "err", err)
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		slog.Warn(
+			"request failed, retrying",
+			append(attrs,
+				"backoff", delay,
+				"retry", retry+1,
+				"max_retries", t.retries,
+			)...,
 		)
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		case <-time.After(delay):
+		}
+
+		wait *= 2
+	}
+}
+
+// NewStartTimeCollector creates a collector exposing the Unix time at which
+// the exporter was started.
+func NewStartTimeCollector(opts collector.MetricsOpts, start time.Time) prometheus.Collector {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "exporter_start_time_seconds",
+		Help:        "Unix time at which the exporter was started",
+		ConstLabels: opts.ConstLabels,
+	})
+	g.Set(float64(start.UnixNano()) / 1e9)
+
+	return g
+}
+
+// NewBuildInfoCollector creates a collector exposing a constant metric with
+// the version, revision and Go version of the exporter as labels. It fails if
+// a constant label of opts has the name of one of them.
+func NewBuildInfoCollector(opts collector.MetricsOpts) (prometheus.Collector, error) {
+	labels := prometheus.Labels{
+		"version":   version,
+		"revision":  revision,
+		"goversion": runtime.Version(),
+	}
+
+	for name, value := range opts.ConstLabels {
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("constant label name %q is reserved", name)
+		}
+
+		labels[name] = value
+	}
+
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "exporter_build_info",
+			Help:        "A metric with a constant '1' value labeled by version, revision and goversion of the exporter",
+			ConstLabels: labels,
+		},
+		func() float64 { return 1 },
+	), nil
+}
+
+// instrumentHandler instruments handler with the number, duration and
+// in-flight count of the requests it serves, registering the metrics with
+// reg. Unlike the scrape duration, these measure the exporter serving
+// Prometheus, which helps detect scrape storms hitting the exporter itself.
+func instrumentHandler(
+	opts collector.MetricsOpts,
+	reg prometheus.Registerer,
+	handler http.Handler,
+) http.Handler {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "exporter_http_requests_total",
+		Help:        "Total number of requests to the metrics path of the exporter by status code",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"code"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "exporter_http_request_duration_seconds",
+		Help:        "Duration of the requests to the metrics path of the exporter by status code",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"code"})
+	inFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "exporter_http_requests_in_flight",
+		Help:        "Number of requests to the metrics path of the exporter being served",
+		ConstLabels: opts.ConstLabels,
+	})
+	reg.MustRegister(requests, duration, inFlight)
+
+	return promhttp.InstrumentHandlerInFlight(
+		inFlight,
+		promhttp.InstrumentHandlerDuration(
+			duration,
+			promhttp.InstrumentHandlerCounter(requests, handler),
+		),
+	)
+}
+
+// checkEndpoints fetches the metrics of each endpoint and writes them to w in
+// a human-readable form, along with the error of each endpoint that could not
+// be scraped. It fails if any endpoint could not be scraped.
+func checkEndpoints(
+	ctx context.Context,
+	w io.Writer,
+	client *http.Client,
+	fetch collector.FetchStatsFunc,
+	endpoints []string,
+) error {
+	failed := 0
+
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "%v\n", collector.RedactURL(endpoint))
+
+		scraper := collector.Scraper{Endpoint: endpoint, Client: client, Fetch: fetch}
+
+		s, err := scraper.Scrape(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "  error: %v\n", err)
+			failed++
+			continue
+		}
+
+		for _, f := range []struct {
+			name  string
+			value int64
+		}{
+			{"active connections", s.Connections.Active},
+			{"accepted connections", s.Connections.Accepted},
+			{"handled connections", s.Connections.Handled},
+			{"reading connections", s.Connections.Reading},
+			{"writing connections", s.Connections.Writing},
+			{"waiting connections", s.Connections.Waiting},
+			{"requests", s.Requests},
+		} {
+			fmt.Fprintf(w, "  %-22v %d\n", f.name+":", f.value)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d endpoints failed", failed, len(endpoints))
+	}
+
+	return nil
+}
+
+// writeConfig writes the settings of the exporter, given as pairs of names and
+// values, to w in a human-readable form.
+func writeConfig(w io.Writer, settings [][2]string) {
+	for _, setting := range settings {
+		fmt.Fprintf(w, "%-28v %v\n", setting[0]+":", setting[1])
 	}
+}
+
+// dumpMetrics writes the metrics gathered from gatherer along with those
+// collected by c to w in the Prometheus text format. The scrapes of the NGINX
+// status endpoints are bounded by ctx.
+func dumpMetrics(
+	ctx context.Context,
+	w io.Writer,
+	c *collector.CollectMetrics,
+	gatherer prometheus.Gatherer,
+) error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.WithContext(ctx))
 
-	body, err := io.ReadAll(resp.Body)
+	mfs, err := prometheus.Gatherers{gatherer, reg}.Gather()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read the response body: %w", err)
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// statusFetcher returns the function fetching the metrics of status endpoints
+// in the given format: stub for stub_status pages, plus for the NGINX Plus
+// API, or vts for the JSON status of nginx-module-vts. Strict only applies to
+// stub_status pages.
+func statusFetcher(format string, strict bool) (collector.FetchStatsFunc, error) {
+	switch format {
+	case "stub":
+		if strict {
+			return collector.GetStubStatsStrict, nil
+		}
+		return collector.GetStubStats, nil
+	case "plus":
+		return collector.GetPlusStats, nil
+	case "vts":
+		return collector.GetVTSStats, nil
+	default:
+		return nil, fmt.Errorf("invalid status format %q: must be stub, plus or vts", format)
+	}
+}
+
+// buildEndpoint assembles the URL of a status endpoint from its parts. The
+// port may be empty to use the default port of the scheme.
+func buildEndpoint(scheme, host, port, path string) (string, error) {
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("invalid scheme %q: must be http or https", scheme)
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" || strings.ContainsAny(host, "/?#@") {
+		return "", fmt.Errorf("invalid host %q", host)
 	}
 
-	r := bytes.NewReader(body)
+	if port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return "", fmt.Errorf("invalid port %q: must be between 1 and 65535", port)
+		}
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	u := url.URL{
+		Scheme: scheme,
+		Host:   host,
+		Path:   "/" + strings.TrimPrefix(path, "/"),
+	}
+
+	return u.String(), nil
+}
 
-	stats, err := parseStubStats(r)
+// parseProxyURL parses the URL of a forward proxy for requests to the status
+// endpoints.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
 	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
 		return nil, fmt.Errorf(
-			"failed to parse response body %q: %w",
-			string(body),
-			err,
+			"invalid proxy URL %v: unsupported scheme %q",
+			u.Redacted(),
+			u.Scheme,
 		)
 	}
 
-	return stats, nil
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %v: missing host", u.Redacted())
+	}
+
+	return u, nil
 }
 
-func parseStubStats(r io.Reader) (*StubStats, error) {
-	var s StubStats
-	if _, err := fmt.Fscanf(r, templateMetrics,
-		&s.Connections.Active,
-		&s.Connections.Accepted,
-		&s.Connections.Handled,
-		&s.Requests,
-		&s.Connections.Reading,
-		&s.Connections.Writing,
-		&s.Connections.Waiting); err != nil {
-		return nil, fmt.Errorf("failed to scan template metrics: %w", err)
+// validateEndpoint checks that endpoint is an http, https or unix URL with a
+// host or, for unix URLs, a socket path.
+func validateEndpoint(endpoint string) error {
+	if !strings.Contains(endpoint, "://") {
+		return fmt.Errorf(
+			"invalid endpoint %v: missing scheme, such as http://",
+			collector.RedactURL(endpoint),
+		)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Hostname() == "" {
+			return fmt.Errorf("invalid endpoint %v: missing host", u.Redacted())
+		}
+	case "unix":
+		if socketPath, _, _ := strings.Cut(u.Path, ":"); socketPath == "" {
+			return fmt.Errorf("invalid endpoint %v: missing socket path", u.Redacted())
+		}
+	default:
+		return fmt.Errorf(
+			"invalid endpoint %v: unsupported scheme %q",
+			u.Redacted(),
+			u.Scheme,
+		)
 	}
 
-	return &s, nil
+	return nil
 }
 
-// Metrics holds descriptions for NGINX-related metrics.
-type metrics struct {
-	ActiveConnectionsDesc   *prometheus.Desc
-	ConnectionsReadingDesc  *prometheus.Desc
-	ConnectionsAcceptedDesc *prometheus.Desc
-	ConnectionsHandledDesc  *prometheus.Desc
-	ConnectionsWaitingDesc  *prometheus.Desc
-	ConnectionsWritingDesc  *prometheus.Desc
-	HTTPRequestsTotalDesc   *prometheus.Desc
+// expandEndpoint replaces references to environment variables in endpoint,
+// such as ${NGINX_HOST}, with their values, so that a single configuration
+// template can be resolved from the environment of each deployment, and $$
+// with a literal $. It fails if a referenced variable is unset or empty.
+func expandEndpoint(endpoint string) (string, error) {
+	var empty []string
+
+	expanded := os.Expand(endpoint, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+
+		v := os.Getenv(name)
+		if v == "" && !slices.Contains(empty, name) {
+			empty = append(empty, name)
+		}
+		return v
+	})
+
+	if len(empty) > 0 {
+		return "", fmt.Errorf(
+			"invalid endpoint %v: unset or empty environment variables %v",
+			collector.RedactURL(endpoint),
+			strings.Join(empty, ", "),
+		)
+	}
+
+	return expanded, nil
 }
 
-// NewMetrics initializes all metric descriptions.
-func NewMetrics(namespace string) *metrics {
-	return &metrics{
-		ActiveConnectionsDesc: prometheus.NewDesc(
-			namespace+"_connections_active",
-			"Active client connections",
-			nil, nil,
-		),
-		ConnectionsReadingDesc: prometheus.NewDesc(
-			namespace+"_connections_reading",
-			"Connections currently reading client request headers",
-			nil, nil,
-		),
-		ConnectionsAcceptedDesc: prometheus.NewDesc(
-			namespace+"_connections_accepted_total",
-			"Total accepted client connections",
-			nil, nil,
-		),
-		ConnectionsHandledDesc: prometheus.NewDesc(
-			namespace+"_connections_handled_total",
-			"Total handled client connections",
-			nil, nil,
-		),
-		ConnectionsWaitingDesc: prometheus.NewDesc(
-			namespace+"_connections_waiting",
-			"Idle client connections",
-			nil, nil,
-		),
-		ConnectionsWritingDesc: prometheus.NewDesc(
-			namespace+"_connections_writing",
-			"Connections where NGINX is currently writing responses to clients",
-			nil, nil,
-		),
-		HTTPRequestsTotalDesc: prometheus.NewDesc(
-			namespace+"_http_requests_total",
-			"Total number of HTTP requests handled",
-			nil, nil,
-		),
+// normalizeEndpoint collapses repeated slashes in the path of an http or https
+// endpoint and drops a trailing slash from it, turning
+// http://127.0.0.1//stub_status/ into http://127.0.0.1/stub_status. If
+// defaultPath is not empty, it is used as the path of endpoints without one,
+// turning http://127.0.0.1 into http://127.0.0.1/stub_status.
+func normalizeEndpoint(endpoint, defaultPath string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return endpoint
+	}
+
+	p := u.EscapedPath()
+	if strings.Trim(p, "/") == "" && defaultPath != "" {
+		p = "/" + defaultPath
+	}
+
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+
+	if len(p) > 1 {
+		p = strings.TrimSuffix(p, "/")
+	}
+
+	if u.Path, err = url.PathUnescape(p); err != nil {
+		return endpoint
+	}
+	u.RawPath = p
+
+	return u.String()
+}
+
+// parseConstLabels parses a comma-separated list of name=value pairs into
+// constant labels.
+func parseConstLabels(s string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid constant label %q: expected name=value", pair)
+		}
+
+		name = strings.TrimSpace(name)
+
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid constant label name %q", name)
+		}
+
+		if slices.Contains(reservedLabelNames, name) {
+			return nil, fmt.Errorf("constant label name %q is reserved", name)
+		}
+
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("duplicate constant label name %q", name)
+		}
+
+		labels[name] = strings.TrimSpace(value)
 	}
+
+	return labels, nil
+}
+
+// statusEndpoints reads the comma-separated list of NGINX status endpoints
+// from the NGINX_STATUS_ENDPOINT environment variable, or returns fallback if
+// it is unset.
+func statusEndpoints(fallback []string) []string {
+	if os.Getenv("NGINX_STATUS_ENDPOINT") == "" {
+		return fallback
+	}
+
+	var endpoints []string
+
+	for _, endpoint := range strings.Split(os.Getenv("NGINX_STATUS_ENDPOINT"), ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	return endpoints
 }
 
-// CollectMetrics is a struct that collects metrics dynamically.
-type CollectMetrics struct {
-	metrics *metrics
+// checkInstanceNames returns an error if two endpoints share an instance
+// name, as their metrics would otherwise be exported as the same series.
+func checkInstanceNames(endpoints []string) error {
+	seen := make(map[string]string, len(endpoints))
+
+	for _, endpoint := range endpoints {
+		instance := collector.InstanceName(endpoint)
+		if other, ok := seen[instance]; ok {
+			return fmt.Errorf(
+				"NGINX status endpoints %v and %v share the instance label %q, scrape each host and port once",
+				collector.RedactURL(other),
+				collector.RedactURL(endpoint),
+				instance,
+			)
+		}
+
+		seen[instance] = endpoint
+	}
+
+	return nil
 }
 
-// NewCollector creates a new instance of CollectMetrics.
-func NewCollector(namespace string, reg prometheus.Registerer) *CollectMetrics {
-	m := NewMetrics(namespace)
-	c := &CollectMetrics{metrics: m}
-	reg.MustRegister(c)
-	return c
+// secondaryEndpoints reads the comma-separated list of secondary endpoints
+// from the NGINX_STATUS_SECONDARY_ENDPOINT environment variable, returning
+// them keyed by the endpoint at the same position in endpoints. Empty entries
+// leave the endpoint at their position without a secondary. Secondaries are
+// normalized like endpoints, using defaultPath for those without a path.
+func secondaryEndpoints(endpoints []string, defaultPath string) (map[string]string, error) {
+	v := os.Getenv("NGINX_STATUS_SECONDARY_ENDPOINT")
+	if v == "" {
+		return nil, nil
+	}
+
+	list := strings.Split(v, ",")
+	if len(list) > len(endpoints) {
+		return nil, fmt.Errorf(
+			"invalid NGINX_STATUS_SECONDARY_ENDPOINT %q: %d secondaries for %d endpoints",
+			v,
+			len(list),
+			len(endpoints),
+		)
+	}
+
+	secondaries := make(map[string]string)
+
+	for i, secondary := range list {
+		secondary = strings.TrimSpace(secondary)
+		if secondary == "" {
+			continue
+		}
+
+		secondary, err := expandEndpoint(secondary)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := validateEndpoint(secondary); err != nil {
+			return nil, err
+		}
+
+		secondaries[endpoints[i]] = normalizeEndpoint(secondary, defaultPath)
+	}
+
+	return secondaries, nil
 }
 
-// Describe sends metric descriptions to the provided channel.
-func (c *CollectMetrics) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.metrics.ActiveConnectionsDesc
-	ch <- c.metrics.ConnectionsReadingDesc
-	ch <- c.metrics.ConnectionsAcceptedDesc
-	ch <- c.metrics.ConnectionsHandledDesc
-	ch <- c.metrics.ConnectionsWaitingDesc
-	ch <- c.metrics.ConnectionsWritingDesc
-	ch <- c.metrics.HTTPRequestsTotalDesc
+// getEnvSeconds returns the duration in seconds held by the environment
+// variable key, or fallback if it is unset or empty.
+func getEnvSeconds(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %q: %w", key, v, err)
+	}
+
+	if seconds <= 0 {
+		return 0, fmt.Errorf("invalid %v %q: must be positive", key, v)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
 }
 
-// Collect dynamically collects metrics and sends them to Prometheus.
-func (c *CollectMetrics) Collect(ch chan<- prometheus.Metric) {
-	endpoint := os.Getenv("NGINX_STATUS_ENDPOINT")
+// getEnvDuration returns the non-negative duration, such as 1s or 500ms, held
+// by the environment variable key, or fallback if it is unset or empty.
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
 
-	nginxStats, err := GetStubStats(endpoint)
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		log.Println(err)
-		return
+		return 0, fmt.Errorf("invalid %v %q: %w", key, v, err)
 	}
 
-	activeConnections := float64(nginxStats.Connections.Active)
-	connectionsReading := float64(nginxStats.Connections.Reading)
-	connectionsAccepted := float64(nginxStats.Connections.Accepted)
-	connectionsHandled := float64(nginxStats.Connections.Handled)
-	connectionsWaiting := float64(nginxStats.Connections.Waiting)
-	connectionsWriting := float64(nginxStats.Connections.Writing)
-	httpRequestsTotal := float64(nginxStats.Requests)
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %v %q: must not be negative", key, v)
+	}
 
-	ch <- prometheus.MustNewConstMetric(c.metrics.ActiveConnectionsDesc, prometheus.GaugeValue, activeConnections)
-	ch <- prometheus.MustNewConstMetric(c.metrics.ConnectionsReadingDesc, prometheus.GaugeValue, connectionsReading)
-	ch <- prometheus.MustNewConstMetric(c.metrics.ConnectionsAcceptedDesc, prometheus.CounterValue, connectionsAccepted)
-	ch <- prometheus.MustNewConstMetric(c.metrics.ConnectionsHandledDesc, prometheus.CounterValue, connectionsHandled)
-	ch <- prometheus.MustNewConstMetric(c.metrics.ConnectionsWaitingDesc, prometheus.GaugeValue, connectionsWaiting)
-	ch <- prometheus.MustNewConstMetric(c.metrics.ConnectionsWritingDesc, prometheus.GaugeValue, connectionsWriting)
-	ch <- prometheus.MustNewConstMetric(c.metrics.HTTPRequestsTotalDesc, prometheus.CounterValue, httpRequestsTotal)
+	return d, nil
 }
 
-func main() {
-	mux := http.NewServeMux()
+// getEnvFloat returns the value of the environment variable key as a
+// non-negative number, or fallback if it is unset.
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
 
-	reg := prometheus.NewRegistry()
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %q: %w", key, v, err)
+	}
 
-	NewCollector("nginx", reg)
+	if f < 0 {
+		return 0, fmt.Errorf("invalid %v %q: must not be negative", key, v)
+	}
+
+	return f, nil
+}
+
+// getEnvFloats returns the value of the environment variable key as a
+// comma-separated, increasing list of numbers, or fallback if it is unset.
+func getEnvFloats(key string, fallback []float64) ([]float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+
+	var fs []float64
+
+	for _, s := range strings.Split(v, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %w", key, v, err)
+		}
+
+		if len(fs) > 0 && f <= fs[len(fs)-1] {
+			return nil, fmt.Errorf("invalid %v %q: must be increasing", key, v)
+		}
+
+		fs = append(fs, f)
+	}
+
+	return fs, nil
+}
+
+// getEnvInt returns the non-negative integer held by the environment variable
+// key, or fallback if it is unset or empty.
+func getEnvInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %q: %w", key, v, err)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("invalid %v %q: must not be negative", key, v)
+	}
+
+	return n, nil
+}
+
+// landingPageHandler serves a small HTML page linking to the metrics path.
+func landingPageHandler(telemetryPath string) http.Handler {
+	page := fmt.Sprintf(templateLandingPage, html.EscapeString(telemetryPath))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	})
+}
+
+// healthzHandler reports that the exporter is alive without scraping NGINX.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// readyzHandler reports whether every NGINX status endpoint of c can be
+// scraped, responding with 503 Service Unavailable if any of them fails. The
+// endpoints are scraped like for the telemetry path, so cached metrics and the
+// minimum scrape interval apply. Since the response is not authenticated, it
+// only names the failing instance, and the error is logged instead.
+func readyzHandler(c *collector.CollectMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, endpoint := range c.Endpoints() {
+			if _, _, err := c.Scrape(r.Context(), endpoint); err != nil {
+				slog.Warn(
+					"readiness check failed",
+					"endpoint", collector.RedactURL(endpoint),
+					"err", err,
+				)
+
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(
+					w,
+					"not ready: failed to scrape %v\n",
+					collector.InstanceName(endpoint),
+				)
+
+				var statusErr *collector.StatusError
+				if errors.As(err, &statusErr) && statusErr.Hint() != "" {
+					fmt.Fprintf(w, "hint: %v\n", statusErr.Hint())
+				}
+				return
+			}
+		}
+
+		io.WriteString(w, "ok\n")
+	})
+}
 
-	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+// statsJSONHandler responds with the metrics of every endpoint of c as JSON,
+// scraped like for the telemetry path.
+func statsJSONHandler(c *collector.CollectMetrics) http.Handler {
+	type endpointStats struct {
+		Instance string               `json:"instance"`
+		Stats    *collector.StubStats `json:"stats,omitempty"`
+		Error    string               `json:"error,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if timeout, ok := collector.PrometheusScrapeTimeout(r); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		endpoints := c.Endpoints()
+		resp := make([]endpointStats, 0, len(endpoints))
+
+		for _, endpoint := range endpoints {
+			e := endpointStats{Instance: collector.InstanceName(endpoint)}
+
+			stats, _, err := c.Scrape(ctx, endpoint)
+			if err != nil {
+				e.Error = err.Error()
+			} else {
+				e.Stats = stats
+			}
+
+			resp = append(resp, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Warn("failed to write stats", "err", err)
+		}
+	})
+}
+
+// recentErrorsHandler responds with the recent scrape errors of c as JSON,
+// oldest first.
+func recentErrorsHandler(c *collector.CollectMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.RecentErrors()); err != nil {
+			slog.Warn("failed to write recent errors", "err", err)
+		}
+	})
+}
+
+// debugStatusHandler responds with the raw body of the status endpoint whose
+// instance name is given by the instance query parameter, which may be
+// omitted if there is a single endpoint. Bodies are fetched through c, so the
+// minimum scrape interval applies.
+func debugStatusHandler(c *collector.CollectMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoints := c.Endpoints()
+
+		instance := r.URL.Query().Get("instance")
+		if instance == "" && len(endpoints) == 1 {
+			instance = collector.InstanceName(endpoints[0])
+		}
+
+		i := slices.IndexFunc(endpoints, func(endpoint string) bool {
+			return collector.InstanceName(endpoint) == instance
+		})
+		if i < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "instance parameter must be one of:\n")
+			for _, endpoint := range endpoints {
+				fmt.Fprintf(w, "%v\n", collector.InstanceName(endpoint))
+			}
+			return
+		}
+
+		body, err := c.StatusBody(r.Context(), endpoints[i])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(body)
+	})
+}
+
+// newLogger creates a logger writing messages at or above level to w in the
+// given format. Unless dedupInterval is zero, identical warnings and errors
+// are logged at most once per dedupInterval.
+func newLogger(
+	w io.Writer,
+	level, format string,
+	dedupInterval time.Duration,
+) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+
+	var h slog.Handler
+
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+
+	if dedupInterval > 0 {
+		h = newDedupHandler(h, dedupInterval)
+	}
+
+	return slog.New(h), nil
+}
+
+// fatal logs msg and args at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// getEnv returns the value of the environment variable key, or fallback if
+// it is unset or empty.
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
 
-	mux.Handle("/metrics", handler)
+	return fallback
+}
+
+// getEnvBool returns the boolean value of the environment variable key, or
+// fallback if it is unset or empty.
+func getEnvBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %v %q: %w", key, v, err)
+	}
+
+	return b, nil
+}
+
+// mustGetEnvBool is like getEnvBool but exits if the value is invalid.
+func mustGetEnvBool(key string) bool {
+	b, err := getEnvBool(key, false)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	return b
+}
+
+// validateListenAddress checks that addr is a valid host:port pair.
+func validateListenAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+
+	return nil
+}
+
+func main() {
+	configFile := flag.String(
+		"config.file",
+		getEnv("CONFIG_FILE", ""),
+		"Path to a YAML configuration file (env CONFIG_FILE)",
+	)
+
+	listenAddress := flag.String(
+		"web.listen-address",
+		getEnv("WEB_LISTEN_ADDRESS", ":9113"),
+		"Address on which to expose metrics (env WEB_LISTEN_ADDRESS)",
+	)
+
+	systemdSocket := flag.Bool(
+		"web.systemd-socket",
+		mustGetEnvBool("WEB_SYSTEMD_SOCKET"),
+		"Use the sockets passed by systemd socket activation instead of the listen address when there are any (env WEB_SYSTEMD_SOCKET)",
+	)
+
+	tlsCertFile := flag.String(
+		"web.tls-cert-file",
+		getEnv("WEB_TLS_CERT_FILE", ""),
+		"Certificate file for serving metrics over HTTPS (env WEB_TLS_CERT_FILE)",
+	)
+
+	tlsKeyFile := flag.String(
+		"web.tls-key-file",
+		getEnv("WEB_TLS_KEY_FILE", ""),
+		"Key file for serving metrics over HTTPS (env WEB_TLS_KEY_FILE)",
+	)
+
+	telemetryPath := flag.String(
+		"web.telemetry-path",
+		getEnv("TELEMETRY_PATH", "/metrics"),
+		"Path under which to expose metrics (env TELEMETRY_PATH)",
+	)
+
+	namespace := flag.String(
+		"metrics.namespace",
+		getEnv("METRICS_NAMESPACE", "nginx"),
+		"Namespace prefixed to metric names (env METRICS_NAMESPACE)",
+	)
+
+	subsystem := flag.String(
+		"metrics.subsystem",
+		getEnv("METRICS_SUBSYSTEM", ""),
+		"Subsystem added to metric names after the namespace (env METRICS_SUBSYSTEM)",
+	)
+
+	logLevel := flag.String(
+		"log.level",
+		getEnv("LOG_LEVEL", "info"),
+		"Minimum level of logged messages: debug, info, warn or error (env LOG_LEVEL)",
+	)
+
+	logFormat := flag.String(
+		"log.format",
+		getEnv("LOG_FORMAT", "text"),
+		"Format of logged messages: text or json (env LOG_FORMAT)",
+	)
+
+	disableExporterMetrics := flag.Bool(
+		"web.disable-exporter-metrics",
+		mustGetEnvBool("WEB_DISABLE_EXPORTER_METRICS"),
+		"Exclude Go runtime and process metrics of the exporter itself (env WEB_DISABLE_EXPORTER_METRICS)",
+	)
+
+	enableStatsJSON := flag.Bool(
+		"web.enable-stats-json",
+		mustGetEnvBool("WEB_ENABLE_STATS_JSON"),
+		"Serve the metrics of the status endpoints as JSON under /stats.json (env WEB_ENABLE_STATS_JSON)",
+	)
+
+	enableDebugStatus := flag.Bool(
+		"web.enable-debug-status",
+		mustGetEnvBool("WEB_ENABLE_DEBUG_STATUS"),
+		"Serve the raw responses of the status endpoints under /debug/status (env WEB_ENABLE_DEBUG_STATUS)",
+	)
+
+	enableDebugErrors := flag.Bool(
+		"web.enable-debug-errors",
+		mustGetEnvBool("WEB_ENABLE_DEBUG_ERRORS"),
+		"Serve the recent scrape errors as JSON under -web.debug-errors-path (env WEB_ENABLE_DEBUG_ERRORS)",
+	)
+
+	debugErrorsPath := flag.String(
+		"web.debug-errors-path",
+		getEnv("WEB_DEBUG_ERRORS_PATH", "/debug/errors"),
+		"Path under which to serve the recent scrape errors (env WEB_DEBUG_ERRORS_PATH)",
+	)
+
+	enablePprof := flag.Bool(
+		"web.enable-pprof",
+		mustGetEnvBool("WEB_ENABLE_PPROF"),
+		"Serve runtime profiles of the exporter under /debug/pprof/ (env WEB_ENABLE_PPROF)",
+	)
+
+	probeOnly := flag.Bool(
+		"web.probe-only",
+		mustGetEnvBool("WEB_PROBE_ONLY"),
+		"Only scrape the targets of /probe, serving the metrics of the exporter itself under the telemetry path (env WEB_PROBE_ONLY)",
+	)
+
+	oneshot := flag.Bool(
+		"oneshot",
+		false,
+		"Scrape once, print the metrics to stdout in the Prometheus text format and exit",
+	)
+
+	dryRun := flag.Bool(
+		"dry-run",
+		false,
+		"Validate the configuration, print the effective configuration and exit without scraping, with a non-zero status if it is invalid",
+	)
+
+	testEndpoint := flag.Bool(
+		"test.endpoint",
+		false,
+		"Check that the status endpoints can be scraped, print their metrics and exit, with a non-zero status on failure",
+	)
+
+	showVersion := flag.Bool(
+		"version",
+		false,
+		"Print version information and exit",
+	)
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf(
+			"custom-nginx-exporter, version %v (revision: %v)\n  build date: %v\n  go version: %v\n",
+			version,
+			revision,
+			buildDate,
+			runtime.Version(),
+		)
+		return
+	}
+
+	logDedupInterval, err := getEnvDuration("LOG_DEDUP_INTERVAL", defaultLogDedupInterval)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat, logDedupInterval)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	slog.SetDefault(logger)
+
+	cfg, err := loadFileConfig(*configFile)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	if err := cfg.applyToFlags(flag.CommandLine); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	if *dryRun && (*testEndpoint || *oneshot) {
+		fatal("invalid configuration, -dry-run cannot be combined with -test.endpoint or -oneshot")
+	}
+
+	if *probeOnly && (*testEndpoint || *oneshot) {
+		fatal("invalid configuration, -web.probe-only cannot be combined with -test.endpoint or -oneshot")
+	}
+
+	if err := validateListenAddress(*listenAddress); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	if !strings.HasPrefix(*telemetryPath, "/") {
+		fatal("invalid telemetry path, must start with /", "path", *telemetryPath)
+	}
+
+	if !strings.HasPrefix(*debugErrorsPath, "/") || *debugErrorsPath == *telemetryPath {
+		fatal(
+			"invalid debug errors path, must start with / and differ from the telemetry path",
+			"path", *debugErrorsPath,
+		)
+	}
+
+	if !metricNamePartRE.MatchString(*namespace) {
+		fatal("invalid metrics namespace", "namespace", *namespace)
+	}
+
+	if *subsystem != "" && !metricNamePartRE.MatchString(*subsystem) {
+		fatal("invalid metrics subsystem", "subsystem", *subsystem)
+	}
+
+	format := getEnv("STATUS_FORMAT", "stub")
+
+	fetch, err := statusFetcher(format, mustGetEnvBool("NGINX_STATUS_STRICT"))
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	constLabels, err := parseConstLabels(os.Getenv("CONST_LABELS"))
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	timeout, err := getEnvSeconds(
+		"NGINX_SCRAPE_TIMEOUT_SECONDS",
+		cmp.Or(cfg.Timeout, collector.DefaultScrapeTimeout),
+	)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	idleConnTimeout, err := getEnvSeconds(
+		"NGINX_IDLE_CONN_TIMEOUT_SECONDS",
+		collector.DefaultIdleConnTimeout,
+	)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	responseHeaderTimeout, err := getEnvSeconds("NGINX_HEADER_TIMEOUT_SECONDS", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	cacheTTL, err := getEnvDuration("CACHE_TTL", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	minScrapeInterval, err := getEnvDuration("MIN_SCRAPE_INTERVAL", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	disabledMetrics, unknownMetrics := collector.ParseMetricNames(os.Getenv("DISABLED_METRICS"))
+	if len(unknownMetrics) > 0 {
+		slog.Warn(
+			"ignoring unknown metrics in DISABLED_METRICS",
+			"metrics", unknownMetrics,
+			"known", collector.MetricNames(),
+		)
+	}
+
+	maxConnections, err := getEnvInt("NGINX_MAX_CONNECTIONS", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	workerProcesses, err := getEnvInt("NGINX_WORKER_PROCESSES", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	recentErrors, err := getEnvInt("WEB_DEBUG_ERRORS_SIZE", defaultRecentErrors)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	// Errors are only kept while they can be served.
+	if !*enableDebugErrors {
+		recentErrors = 0
+	}
+
+	concurrency, err := getEnvInt("NGINX_SCRAPE_CONCURRENCY", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	maxBody, err := getEnvInt("NGINX_STATUS_MAX_BODY_BYTES", collector.DefaultMaxBodyBytes)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	retries, err := getEnvInt("NGINX_SCRAPE_RETRIES", 0)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	retryBackoff, err := getEnvSeconds(
+		"NGINX_SCRAPE_RETRY_BACKOFF_SECONDS",
+		defaultRetryBackoff,
+	)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	insecureSkipVerify, err := getEnvBool(
+		"NGINX_STATUS_INSECURE_SKIP_VERIFY",
+		cfg.TLS.InsecureSkipVerify,
+	)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	if insecureSkipVerify {
+		slog.Warn("TLS certificate verification of the NGINX status endpoint is disabled, this is insecure")
+	}
+
+	tlsConfig, err := collector.NewTLSConfig(collector.TLSOpts{
+		CAFile:             getEnv("NGINX_STATUS_CA_FILE", cfg.TLS.CAFile),
+		CertFile:           getEnv("NGINX_STATUS_CERT_FILE", cfg.TLS.CertFile),
+		KeyFile:            getEnv("NGINX_STATUS_KEY_FILE", cfg.TLS.KeyFile),
+		InsecureSkipVerify: insecureSkipVerify,
+	})
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	mux := http.NewServeMux()
+
+	reg := prometheus.NewRegistry()
+
+	clientOpts := collector.HTTPClientOpts{
+		Timeout:               timeout,
+		IdleConnTimeout:       idleConnTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		MaxBodyBytes:          int64(maxBody),
+		TLSConfig:             tlsConfig,
+		H2C:                   mustGetEnvBool("NGINX_STATUS_H2C"),
+	}
+
+	// The transport uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY unless a proxy
+	// is configured explicitly.
+	if proxyURL := os.Getenv("NGINX_STATUS_PROXY_URL"); proxyURL != "" {
+		u, err := parseProxyURL(proxyURL)
+		if err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		clientOpts.Proxy = u
+	}
+
+	if clientOpts.H2C && clientOpts.Proxy != nil {
+		fatal("invalid configuration, NGINX_STATUS_H2C cannot be used with NGINX_STATUS_PROXY_URL")
+	}
+
+	client := collector.NewHTTPClient(clientOpts)
+
+	// Status endpoints behind content-negotiating handlers would otherwise
+	// respond with HTML.
+	accept := "text/plain"
+	if format == "plus" || format == "vts" {
+		accept = "application/json"
+	}
+
+	header := http.Header{
+		"User-Agent": {getEnv("NGINX_STATUS_USER_AGENT", "custom-nginx-exporter/"+version)},
+		"Accept":     {getEnv("NGINX_STATUS_ACCEPT", accept)},
+	}
+
+	client.Transport = &headerTransport{header: header, next: client.Transport}
+
+	username := getEnv("NGINX_STATUS_USERNAME", cfg.BasicAuth.Username)
+	password := getEnv("NGINX_STATUS_PASSWORD", cfg.BasicAuth.Password)
+	passwordFile := os.Getenv("NGINX_STATUS_PASSWORD_FILE")
+
+	if os.Getenv("NGINX_STATUS_PASSWORD") != "" && passwordFile != "" {
+		fatal("invalid configuration, set only one of NGINX_STATUS_PASSWORD and NGINX_STATUS_PASSWORD_FILE")
+	}
+
+	if username != "" && passwordFile != "" {
+		f, err := newSecretFile("password", passwordFile)
+		if err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		client.Transport = &basicAuthTransport{
+			username:     username,
+			passwordFile: f,
+			next:         client.Transport,
+		}
+	} else if username != "" && password != "" {
+		client.Transport = &basicAuthTransport{
+			username: username,
+			password: password,
+			next:     client.Transport,
+		}
+	}
+
+	if mustGetEnvBool("NGINX_STATUS_FOLLOW_REDIRECTS") {
+		client.CheckRedirect = checkSameHostRedirect
+	}
+
+	bearerToken := os.Getenv("NGINX_STATUS_BEARER_TOKEN")
+	bearerTokenFile := os.Getenv("NGINX_STATUS_BEARER_TOKEN_FILE")
+
+	if bearerToken != "" && bearerTokenFile != "" {
+		fatal("invalid configuration, set only one of NGINX_STATUS_BEARER_TOKEN and NGINX_STATUS_BEARER_TOKEN_FILE")
+	}
+
+	if bearerTokenFile != "" {
+		f, err := newSecretFile("bearer token", bearerTokenFile)
+		if err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		client.Transport = &bearerTokenTransport{
+			tokenFile: f,
+			next:      client.Transport,
+		}
+	} else if bearerToken != "" {
+		client.Transport = &bearerTokenTransport{
+			token: bearerToken,
+			next:  client.Transport,
+		}
+	}
+
+	if retries > 0 {
+		client.Transport = &retryTransport{
+			retries: retries,
+			backoff: retryBackoff,
+			next:    client.Transport,
+		}
+	}
+
+	defaultEndpoints := cfg.Endpoints
+
+	if host := os.Getenv("NGINX_STATUS_HOST"); host != "" {
+		endpoint, err := buildEndpoint(
+			getEnv("NGINX_STATUS_SCHEME", "http"),
+			host,
+			os.Getenv("NGINX_STATUS_PORT"),
+			getEnv("NGINX_STATUS_PATH", "/stub_status"),
+		)
+		if err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		defaultEndpoints = []string{endpoint}
+	}
+
+	endpoints := statusEndpoints(defaultEndpoints)
+
+	switch {
+	case *probeOnly && len(endpoints) > 0:
+		slog.Warn("ignoring the configured NGINX status endpoints, as only the targets of /probe are scraped")
+		endpoints = nil
+	case !*probeOnly && len(endpoints) == 0:
+		fatal(
+			"no NGINX status endpoint configured, set NGINX_STATUS_ENDPOINT, NGINX_STATUS_HOST or endpoints in the configuration file",
+			"hint", "point it at the stub_status location, for example NGINX_STATUS_ENDPOINT=http://127.0.0.1/stub_status",
+		)
+	}
+
+	defaultPath := os.Getenv("NGINX_STATUS_DEFAULT_PATH")
+
+	for i, endpoint := range endpoints {
+		expanded, err := expandEndpoint(endpoint)
+		if err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		if err := validateEndpoint(expanded); err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		endpoints[i] = normalizeEndpoint(expanded, defaultPath)
+		slog.Debug(
+			"using NGINX status endpoint",
+			"endpoint", collector.RedactURL(endpoint),
+			"effective", collector.RedactURL(endpoints[i]),
+		)
+	}
+
+	if err := checkInstanceNames(endpoints); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	secondaries, err := secondaryEndpoints(endpoints, defaultPath)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	allowedTargets, err := parseAllowedTargets(os.Getenv("PROBE_ALLOWED_TARGETS"))
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	if *probeOnly && allowedTargets.empty() {
+		fatal("invalid configuration, WEB_PROBE_ONLY requires PROBE_ALLOWED_TARGETS")
+	}
+
+	// The targets of /probe are chosen by its clients, so they are scraped
+	// without the credentials of the configured endpoints.
+	probeClient := newProbeClient(clientOpts, header, allowedTargets)
+	probeClient.CheckRedirect = client.CheckRedirect
+
+	if retries > 0 {
+		probeClient.Transport = &retryTransport{
+			retries: retries,
+			backoff: retryBackoff,
+			next:    probeClient.Transport,
+		}
+	}
+
+	buckets, err := getEnvFloats("SCRAPE_DURATION_BUCKETS", prometheus.DefBuckets)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	nativeBucketFactor, err := getEnvFloat(
+		"SCRAPE_DURATION_NATIVE_FACTOR",
+		collector.DefaultNativeHistogramBucketFactor,
+	)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	opts := collector.MetricsOpts{
+		Namespace:                        *namespace,
+		Subsystem:                        *subsystem,
+		ConstLabels:                      constLabels,
+		ScrapeDurationBuckets:            buckets,
+		ScrapeDurationNativeBucketFactor: nativeBucketFactor,
+		Help:                             cfg.Help,
+	}
+
+	collectorOpts := collector.CollectorOpts{
+		Metrics:             opts,
+		Endpoints:           endpoints,
+		Client:              client,
+		Fetch:               fetch,
+		Secondaries:         secondaries,
+		CacheTTL:            cacheTTL,
+		MinScrapeInterval:   minScrapeInterval,
+		MaxConnections:      maxConnections,
+		WorkerProcesses:     workerProcesses,
+		Concurrency:         concurrency,
+		RecentErrors:        recentErrors,
+		DetectCounterResets: mustGetEnvBool("NGINX_DETECT_COUNTER_RESETS"),
+		DisabledMetrics:     disabledMetrics,
+	}
+
+	buildInfo, err := NewBuildInfoCollector(opts)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	nginxCollector := collector.NewCollectMetrics(collectorOpts)
+	reg.MustRegister(buildInfo, NewStartTimeCollector(opts, startTime))
+
+	if !*disableExporterMetrics {
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	// Scrapes are canceled on SIGINT and SIGTERM, including the one-off ones
+	// of -test.endpoint and -oneshot.
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
+	defer stop()
+
+	if *testEndpoint {
+		if err := checkEndpoints(
+			ctx,
+			os.Stdout,
+			client,
+			fetch,
+			endpoints,
+		); err != nil {
+			fatal("endpoint check failed", "err", err)
+		}
+		return
+	}
+
+	if *oneshot {
+		if err := dumpMetrics(ctx, os.Stdout, nginxCollector, reg); err != nil {
+			fatal("failed to dump metrics", "err", err)
+		}
+		return
+	}
+
+	webAuthUsername := os.Getenv("WEB_AUTH_USERNAME")
+	webAuthPassword := os.Getenv("WEB_AUTH_PASSWORD")
+
+	if err := validateWebAuth(webAuthUsername, webAuthPassword); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+
+	// OpenMetrics is negotiated so that exemplars are exposed.
+	handlerOpts := promhttp.HandlerOpts{EnableOpenMetrics: true}
+
+	handler := collector.MetricsHandler(nginxCollector, reg, handlerOpts)
+	if *probeOnly {
+		handler = promhttp.HandlerFor(reg, handlerOpts)
+	}
+
+	if webAuthUsername != "" {
+		handler = basicAuthHandler(webAuthUsername, webAuthPassword, handler)
+	}
+
+	mux.Handle(*telemetryPath, instrumentHandler(opts, reg, handler))
+
+	// Probing is opt-in, as it makes the exporter send requests to the hosts
+	// chosen by its clients.
+	if !allowedTargets.empty() {
+		probeOpts := collectorOpts
+		probeOpts.Client = probeClient
+
+		probe := probeHandler(probeOpts, allowedTargets, handlerOpts)
+		if webAuthUsername != "" {
+			probe = basicAuthHandler(webAuthUsername, webAuthPassword, probe)
+		}
+
+		mux.Handle("/probe", probe)
+	}
+
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(nginxCollector))
+
+	if *enableStatsJSON {
+		stats := statsJSONHandler(nginxCollector)
+		if webAuthUsername != "" {
+			stats = basicAuthHandler(webAuthUsername, webAuthPassword, stats)
+		}
+
+		mux.Handle("/stats.json", stats)
+	}
+
+	if *enablePprof {
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		var profiles http.Handler = pprofMux
+		if webAuthUsername != "" {
+			profiles = basicAuthHandler(webAuthUsername, webAuthPassword, profiles)
+		}
+
+		mux.Handle("/debug/pprof/", profiles)
+	}
+
+	if *enableDebugErrors {
+		recent := recentErrorsHandler(nginxCollector)
+		if webAuthUsername != "" {
+			recent = basicAuthHandler(webAuthUsername, webAuthPassword, recent)
+		}
+
+		mux.Handle(*debugErrorsPath, recent)
+	}
+
+	if *enableDebugStatus {
+		debug := debugStatusHandler(nginxCollector)
+		if webAuthUsername != "" {
+			debug = basicAuthHandler(webAuthUsername, webAuthPassword, debug)
+		}
+
+		mux.Handle("/debug/status", debug)
+	}
+
+	if *telemetryPath != "/" {
+		mux.Handle("/", landingPageHandler(*telemetryPath))
+	}
+
+	// Requests derive their context from rootCtx, which is canceled on
+	// shutdown so that in-flight scrapes of slow endpoints do not delay exit.
+	rootCtx, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+
+	srv := &http.Server{
+		Addr:    *listenAddress,
+		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return rootCtx
+		},
+	}
+
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		certs, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			fatal("invalid configuration", "err", err)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+	}
+
+	if *dryRun {
+		redacted := make([]string, len(endpoints))
+		for i, endpoint := range endpoints {
+			redacted[i] = collector.RedactURL(endpoint)
+		}
+
+		writeConfig(os.Stdout, [][2]string{
+			{"endpoints", strings.Join(redacted, ", ")},
+			{"probe only", strconv.FormatBool(*probeOnly)},
+			{"status format", format},
+			{"scrape timeout", timeout.String()},
+			{"idle connection timeout", idleConnTimeout.String()},
+			{"response header timeout", responseHeaderTimeout.String()},
+			{"retries", strconv.Itoa(retries)},
+			{"cache TTL", cacheTTL.String()},
+			{"minimum scrape interval", minScrapeInterval.String()},
+			{"scrape concurrency", strconv.Itoa(nginxCollector.Concurrency())},
+			{"listen address", *listenAddress},
+			{"telemetry path", *telemetryPath},
+			{"web TLS", strconv.FormatBool(srv.TLSConfig != nil)},
+			{"web basic auth", strconv.FormatBool(webAuthUsername != "")},
+			{"metrics namespace", *namespace},
+			{"metrics subsystem", *subsystem},
+			{"constant labels", fmt.Sprint(constLabels)},
+			{"disabled metrics", strings.Join(disabledMetrics, ", ")},
+			{"log level", *logLevel},
+			{"log format", *logFormat},
+		})
+		return
+	}
+
+	listeners, err := webListeners(*listenAddress, *systemdSocket)
+	if err != nil {
+		fatal("failed to start HTTP server", "err", err)
+	}
+
+	for _, l := range listeners {
+		slog.Info(
+			"starting exporter",
+			"version", version,
+			"address", l.Addr().String(),
+			"tls", srv.TLSConfig != nil,
+		)
+
+		go func() {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("failed to start HTTP server", "err", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+
+	slog.Info("shutting down, waiting for in-flight requests to complete")
+
+	cancelRoot()
+
+	shutdownCtx, cancel := context.WithTimeout(
+		context.Background(),
+		shutdownGracePeriod,
+	)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down gracefully", "err", err)
+		return
+	}
 
-	http.ListenAndServe(":9113", mux)
+	slog.Info("shutdown complete")
 }
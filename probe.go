@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/betterstack-community/custom-nginx-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler serves the metrics of the endpoint given by the target query
+// parameter, using a collector created for each request from opts, whose
+// client should be created by newProbeClient. Targets rejected by allowed are
+// not probed. The options describing the configured endpoints, such as their
+// secondaries and the limits of their NGINX, are not applied to targets, and
+// only the target is scraped.
+func probeHandler(
+	opts collector.CollectorOpts,
+	allowed *targetAllowlist,
+	handlerOpts promhttp.HandlerOpts,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		if err := validateEndpoint(target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := allowed.check(r.Context(), target); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		// The dialer of the client checks the addresses connected to against
+		// the allowlist again, which depends on the target.
+		r = r.WithContext(context.WithValue(r.Context(), probeTargetKey{}, target))
+
+		opts.Endpoints = []string{target}
+		opts.Secondaries = nil
+		opts.WorkerProcesses = 0
+		opts.MaxConnections = 0
+		opts.CacheTTL = 0
+		opts.MinScrapeInterval = 0
+		opts.DetectCounterResets = false
+		opts.RecentErrors = 0
+
+		collector.MetricsHandler(
+			collector.NewCollectMetrics(opts),
+			prometheus.Gatherers{},
+			handlerOpts,
+		).ServeHTTP(w, r)
+	})
+}
+
+// probeTargetKey is the context key of the target probed by a request.
+type probeTargetKey struct{}
+
+// newProbeClient creates the client scraping the targets of /probe from the
+// options of the client of the configured endpoints, sending header with every
+// request. Unlike the targets of that client, the targets of /probe are chosen
+// by whoever can reach the exporter, so no client certificate is presented,
+// credentials are not added, and connections are only made to addresses
+// allowed by allowed.
+func newProbeClient(
+	opts collector.HTTPClientOpts,
+	header http.Header,
+	allowed *targetAllowlist,
+) *http.Client {
+	if opts.TLSConfig != nil {
+		opts.TLSConfig = opts.TLSConfig.Clone()
+		opts.TLSConfig.Certificates = nil
+		opts.TLSConfig.GetClientCertificate = nil
+	}
+
+	opts.DialControl = allowed.checkAddr
+
+	client := collector.NewHTTPClient(opts)
+	client.Transport = &headerTransport{header: header, next: client.Transport}
+
+	return client
+}
+
+// targetAllowlist restricts the endpoints that may be probed.
+type targetAllowlist struct {
+	// names are allowed endpoints, host:port pairs or host names.
+	names []string
+
+	// prefixes are allowed IP address ranges.
+	prefixes []netip.Prefix
+}
+
+// parseAllowedTargets parses a comma-separated list of allowed probe targets:
+// endpoints, host:port pairs, host names, IP addresses or CIDR ranges.
+func parseAllowedTargets(s string) (*targetAllowlist, error) {
+	var allowed targetAllowlist
+
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		if strings.Contains(a, "/") && !strings.Contains(a, "://") {
+			prefix, err := netip.ParsePrefix(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed target range %q: %w", a, err)
+			}
+			allowed.prefixes = append(allowed.prefixes, prefix.Masked())
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(a); err == nil {
+			allowed.prefixes = append(
+				allowed.prefixes,
+				netip.PrefixFrom(addr, addr.BitLen()),
+			)
+		}
+		allowed.names = append(allowed.names, a)
+	}
+
+	return &allowed, nil
+}
+
+// check returns an error if target may not be probed, which requires target
+// to match a name, or all its addresses to be within a range. Targets
+// resolving to a link-local address, such as the cloud metadata endpoint
+// 169.254.169.254, are rejected unless a range covers them. Unix domain
+// socket targets must be listed as such.
+func (a *targetAllowlist) check(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "unix" {
+		if slices.Contains(a.names, target) {
+			return nil
+		}
+		return fmt.Errorf("target %v is not allowed", collector.RedactURL(target))
+	}
+
+	addrs, err := lookupAddrs(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve target %v: %w", collector.RedactURL(target), err)
+	}
+
+	inRange := len(addrs) > 0
+	for _, addr := range addrs {
+		covered := a.covers(addr)
+
+		if !covered && isLinkLocal(addr) {
+			return fmt.Errorf(
+				"target %v resolves to link-local address %v",
+				collector.RedactURL(target),
+				addr,
+			)
+		}
+
+		inRange = inRange && covered
+	}
+
+	if inRange || a.allowsName(target) {
+		return nil
+	}
+
+	return fmt.Errorf("target %v is not allowed", collector.RedactURL(target))
+}
+
+// checkAddr implements net.Dialer.ControlContext for the client of /probe,
+// returning an error if the target probed with ctx may not be connected to at
+// address. Since names may resolve to other addresses when dialed than when
+// the target was checked, the address must again not be link-local unless a
+// range covers it, and must be within a range unless the target matches a
+// name. Through a proxy, the address is the one of the proxy.
+func (a *targetAllowlist) checkAddr(
+	ctx context.Context,
+	network string,
+	address string,
+	_ syscall.RawConn,
+) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr := addrPort.Addr().Unmap().WithZone("")
+	covered := a.covers(addr)
+
+	if !covered && isLinkLocal(addr) {
+		return fmt.Errorf("connecting to link-local address %v is not allowed", addr)
+	}
+
+	if covered {
+		return nil
+	}
+
+	if target, ok := ctx.Value(probeTargetKey{}).(string); ok && a.allowsName(target) {
+		return nil
+	}
+
+	return fmt.Errorf("connecting to %v is not allowed", addr)
+}
+
+// covers reports whether addr is within a range of the allowlist.
+func (a *targetAllowlist) covers(addr netip.Addr) bool {
+	return slices.ContainsFunc(a.prefixes, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// allowsName reports whether target matches a name of the allowlist.
+func (a *targetAllowlist) allowsName(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(a.names, func(n string) bool {
+		return n == target || n == u.Host || n == u.Hostname()
+	})
+}
+
+// isLinkLocal reports whether addr is a link-local address.
+func isLinkLocal(addr netip.Addr) bool {
+	return addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()
+}
+
+// empty reports whether the allowlist has neither names nor ranges.
+func (a *targetAllowlist) empty() bool {
+	return len(a.names) == 0 && len(a.prefixes) == 0
+}
+
+// lookupAddrs returns the IP addresses of host, which may be a literal IP
+// address. IPv4-mapped IPv6 addresses are converted to IPv4 and zones are
+// dropped, so that they match the allowed ranges.
+func lookupAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap().WithZone("")}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.Addr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.Unmap().WithZone("")
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/betterstack-community/custom-nginx-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const validStubStatus = `Active connections: 291
+server accepts handled requests
+ 16630948 16630948 31070465
+Reading: 6 Writing: 179 Waiting: 106
+`
+
+func TestNewProbeClient(t *testing.T) {
+	type request struct {
+		userAgent     string
+		authorization string
+		clientCerts   int
+	}
+	requests := make(chan request, 1)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- request{
+			userAgent:     r.UserAgent(),
+			authorization: r.Header.Get("Authorization"),
+			clientCerts:   len(r.TLS.PeerCertificates),
+		}
+		io.WriteString(w, validStubStatus)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.Certificates = srv.TLS.Certificates
+
+	clientOpts := collector.HTTPClientOpts{Timeout: time.Second, TLSConfig: tlsConfig}
+	header := http.Header{"User-Agent": {"custom-nginx-exporter/test"}}
+
+	// The client of the configured endpoints presents the certificate, so
+	// that the probe client is known to drop it.
+	client := collector.NewHTTPClient(clientOpts)
+	client.Transport = &basicAuthTransport{username: "admin", password: "secret", next: client.Transport}
+
+	if _, err := collector.GetStubStats(context.Background(), client, srv.URL); err != nil {
+		t.Fatalf("GetStubStats() error = %v", err)
+	}
+	if got := <-requests; got.clientCerts != 1 || got.authorization == "" {
+		t.Fatalf("endpoint client sent %+v, want a client certificate and credentials", got)
+	}
+
+	probe := probeHandler(
+		collector.CollectorOpts{
+			Metrics: collector.MetricsOpts{Namespace: "nginx"},
+			Client:  newProbeClient(clientOpts, header, mustParseAllowedTargets(t, "127.0.0.0/8")),
+			Fetch:   collector.GetStubStats,
+		},
+		mustParseAllowedTargets(t, "127.0.0.0/8"),
+		promhttp.HandlerOpts{},
+	)
+
+	rec := httptest.NewRecorder()
+	probe.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet,
+		"/probe?target="+url.QueryEscape(srv.URL),
+		nil,
+	))
+
+	if !strings.Contains(rec.Body.String(), "nginx_up") {
+		t.Fatalf("probe response = %q, want the metrics of the target", rec.Body.String())
+	}
+
+	got := <-requests
+	if got.clientCerts != 0 {
+		t.Errorf("probe client presented %d client certificates, want none", got.clientCerts)
+	}
+	if got.authorization != "" {
+		t.Errorf("probe client sent Authorization %q, want none", got.authorization)
+	}
+	if got.userAgent != "custom-nginx-exporter/test" {
+		t.Errorf("probe client sent User-Agent %q, want custom-nginx-exporter/test", got.userAgent)
+	}
+}
+
+func TestProbeHandlerScrapesOnlyTarget(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	var secondaryCalls atomic.Int32
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryCalls.Add(1)
+		io.WriteString(w, validStubStatus)
+	}))
+	defer secondary.Close()
+
+	probe := probeHandler(
+		collector.CollectorOpts{
+			Metrics:         collector.MetricsOpts{Namespace: "nginx"},
+			Endpoints:       []string{target.URL},
+			Secondaries:     map[string]string{target.URL: secondary.URL},
+			WorkerProcesses: 2,
+			MaxConnections:  1024,
+			Client:          &http.Client{Timeout: time.Second},
+			Fetch:           collector.GetStubStats,
+		},
+		mustParseAllowedTargets(t, "127.0.0.0/8"),
+		promhttp.HandlerOpts{},
+	)
+
+	rec := httptest.NewRecorder()
+	probe.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet,
+		"/probe?target="+url.QueryEscape(target.URL),
+		nil,
+	))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, `nginx_up{instance="`+strings.TrimPrefix(target.URL, "http://")+`"} 0`) {
+		t.Errorf("probe response = %q, want the target down", body)
+	}
+	if got := secondaryCalls.Load(); got != 0 {
+		t.Errorf("secondary requests = %v, want 0", got)
+	}
+	for _, name := range []string{"nginx_worker_processes", "nginx_connections_utilization_ratio"} {
+		if strings.Contains(body, name) {
+			t.Errorf("probe response contains %v, want the configured limits left out", name)
+		}
+	}
+}
+
+func TestProbeHandlerRejectsTargets(t *testing.T) {
+	probe := probeHandler(
+		collector.CollectorOpts{Metrics: collector.MetricsOpts{Namespace: "nginx"}},
+		mustParseAllowedTargets(t, "10.0.0.0/8"),
+		promhttp.HandlerOpts{},
+	)
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"missing", "", http.StatusBadRequest},
+		{"invalid", "ftp://10.0.0.1/stub_status", http.StatusBadRequest},
+		{"outside the allowed ranges", "http://192.168.0.1/stub_status", http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			probe.ServeHTTP(rec, httptest.NewRequest(
+				http.MethodGet,
+				"/probe?target="+url.QueryEscape(tt.target),
+				nil,
+			))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %v, want %v", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func mustParseAllowedTargets(t *testing.T, s string) *targetAllowlist {
+	t.Helper()
+
+	allowed, err := parseAllowedTargets(s)
+	if err != nil {
+		t.Fatalf("parseAllowedTargets(%q) error = %v", s, err)
+	}
+
+	return allowed
+}
+
+func TestTargetAllowlistCheck(t *testing.T) {
+	for _, tt := range []struct {
+		allowed string
+		target  string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "http://10.0.0.1/stub_status", false},
+		{"10.0.0.0/8", "http://192.168.0.1/stub_status", true},
+		{"10.0.0.0/8", "http://169.254.169.254/latest/meta-data/", true},
+		{"10.0.0.0/8", "http://169.254.169.254:80/computeMetadata/v1/", true},
+		{"10.0.0.0/8", "http://[::ffff:169.254.169.254]/latest/meta-data/", true},
+		{"10.0.0.0/8", "http://[fe80::a9fe:a9fe]/latest/meta-data/", true},
+		{"10.0.0.0/8", "http://[fd00:ec2::254]/latest/meta-data/", true},
+		// Link-local addresses are rejected even if the target is listed.
+		{"http://169.254.169.254/latest/meta-data/", "http://169.254.169.254/latest/meta-data/", true},
+		{"169.254.169.254:80", "http://169.254.169.254:80/latest/meta-data/", true},
+		{"169.254.0.0/16", "http://169.254.169.254/latest/meta-data/", false},
+		{"unix:///run/nginx.sock:/stub_status", "unix:///run/nginx.sock:/stub_status", false},
+		{"unix:///run/nginx.sock:/stub_status", "unix:///run/other.sock:/stub_status", true},
+		{"10.0.0.0/8", "unix:///run/nginx.sock:/stub_status", true},
+		{"", "unix:///run/nginx.sock:/stub_status", true},
+		{"", "http://10.0.0.1/stub_status", true},
+		{"::1/128", "http://[::1]:8080/stub_status", false},
+		{"fd00::/8", "http://[fd00::1]:8080/stub_status", false},
+		{"fe80::/10", "http://[fe80::1%25eth0]:8080/stub_status", false},
+		{"fd00::/8", "http://[fe80::1%25eth0]:8080/stub_status", true},
+		{"10.0.0.0/8", "http://[::ffff:10.0.0.1]:8080/stub_status", false},
+	} {
+		t.Run(tt.allowed+" "+tt.target, func(t *testing.T) {
+			err := mustParseAllowedTargets(t, tt.allowed).check(context.Background(), tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTargetAllowlistCheckAddr(t *testing.T) {
+	allowed := mustParseAllowedTargets(t, "nginx.internal,10.0.0.0/8")
+
+	for _, tt := range []struct {
+		target  string
+		address string
+		wantErr bool
+	}{
+		{"http://nginx.internal/stub_status", "10.0.0.1:80", false},
+		{"http://nginx.internal/stub_status", "192.168.0.1:80", false},
+		// The name of an allowed target resolving to the metadata endpoint
+		// when dialed, such as after rebinding its DNS records.
+		{"http://nginx.internal/stub_status", "169.254.169.254:80", true},
+		{"http://nginx.internal/stub_status", "[::ffff:169.254.169.254]:80", true},
+		{"http://nginx.internal/stub_status", "[fe80::1%eth0]:80", true},
+		{"http://other.internal/stub_status", "10.0.0.1:80", false},
+		{"http://other.internal/stub_status", "192.168.0.1:80", true},
+		{"", "192.168.0.1:80", true},
+	} {
+		t.Run(tt.target+" "+tt.address, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.target != "" {
+				ctx = context.WithValue(ctx, probeTargetKey{}, tt.target)
+			}
+
+			err := allowed.checkAddr(ctx, "tcp", tt.address, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAddr() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewProbeClientChecksDialedAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, validStubStatus)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		allowed string
+		wantErr bool
+	}{
+		{"allowed by name", u.Host, false},
+		{"allowed by range", "127.0.0.0/8", false},
+		{"not allowed", "10.0.0.0/8", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newProbeClient(
+				collector.HTTPClientOpts{Timeout: time.Second},
+				nil,
+				mustParseAllowedTargets(t, tt.allowed),
+			)
+
+			ctx := context.WithValue(context.Background(), probeTargetKey{}, srv.URL)
+
+			_, err := collector.GetStubStats(ctx, client, srv.URL)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "not allowed") {
+					t.Fatalf("GetStubStats() error = %v, want the connection to be rejected", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetStubStats() error = %v", err)
+			}
+		})
+	}
+}
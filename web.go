@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// certReloader loads the TLS certificate of the exporter's own web server,
+// loading it again when the certificate or key file changes so that rotated
+// certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader creates a certReloader, failing if the certificate cannot
+// be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("web TLS certificate and key files must be set together")
+	}
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.getCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. If the changed files
+// cannot be loaded, the previously loaded certificate is used.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modTime, err := r.latestModTime()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil && r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, loadErr := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if loadErr != nil {
+		if r.cert != nil {
+			slog.Warn("failed to reload web TLS certificate, using the previous one", "err", loadErr)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load web TLS certificate: %w", loadErr)
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+
+	return r.cert, nil
+}
+
+// latestModTime returns the later modification time of the certificate and
+// key files.
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// basicAuthHandler requires requests to next to carry HTTP basic auth
+// credentials matching username and the bcrypt hash passwordHash.
+func basicAuthHandler(username, passwordHash string, next http.Handler) http.Handler {
+	// bcrypt is slow by design, so the SHA-256 hash of the password verified
+	// last is kept to spare every scrape from verifying it again.
+	var verified atomic.Pointer[[sha256.Size]byte]
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+
+		// The password is checked even if the username is wrong, so that
+		// response times do not reveal valid usernames.
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+
+		sum := sha256.Sum256([]byte(p))
+		passOK := false
+		if v := verified.Load(); v != nil && subtle.ConstantTimeCompare(v[:], sum[:]) == 1 {
+			passOK = true
+		} else if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(p)) == nil {
+			verified.Store(&sum)
+			passOK = true
+		}
+
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="custom-nginx-exporter", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateWebAuth checks the credentials required by basicAuthHandler.
+func validateWebAuth(username, passwordHash string) error {
+	if (username == "") != (passwordHash == "") {
+		return errors.New("web auth username and password must be set together")
+	}
+
+	if username == "" {
+		return nil
+	}
+
+	if _, err := bcrypt.Cost([]byte(passwordHash)); err != nil {
+		return fmt.Errorf("web auth password must be a bcrypt hash: %w", err)
+	}
+
+	return nil
+}
+
+// webListeners returns the listeners the web server is served on. With
+// systemdSocket set, the sockets passed by systemd socket activation are used
+// when there are any, so that systemd can bind privileged ports and keep them
+// open across restarts. Otherwise address is bound.
+func webListeners(address string, systemdSocket bool) ([]net.Listener, error) {
+	if systemdSocket {
+		listeners, err := activation.Listeners()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get systemd sockets: %w", err)
+		}
+
+		if len(listeners) > 0 {
+			return listeners, nil
+		}
+
+		slog.Warn(
+			"no sockets passed by systemd, listening on the configured address",
+			"address", address,
+		)
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return []net.Listener{l}, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := basicAuthHandler("admin", string(hash), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		name     string
+		username string
+		password string
+		noAuth   bool
+		want     int
+	}{
+		{"valid", "admin", "secret", false, http.StatusOK},
+		// The password is verified again from the cache.
+		{"valid again", "admin", "secret", false, http.StatusOK},
+		{"wrong password", "admin", "guess", false, http.StatusUnauthorized},
+		{"wrong username", "root", "secret", false, http.StatusUnauthorized},
+		{"empty password", "admin", "", false, http.StatusUnauthorized},
+		{"no credentials", "", "", true, http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if !tt.noAuth {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %v, want %v", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header not set")
+			}
+		})
+	}
+}
+
+func BenchmarkBasicAuthHandler(b *testing.B) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.DefaultCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	handler := basicAuthHandler("admin", string(hash), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("admin", "secret")
+
+	for range b.N {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}